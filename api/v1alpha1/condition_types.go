@@ -0,0 +1,142 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported in SynapseStatus.
+const (
+	// ConditionSecretReady indicates whether the Secret holding the
+	// signing key and other generated secrets exists.
+	ConditionSecretReady = "SecretReady"
+
+	// ConditionConfigReady indicates whether homeserver.yaml has been
+	// generated from the current spec.
+	ConditionConfigReady = "ConfigReady"
+
+	// ConditionDeploymentAvailable indicates whether the Synapse
+	// Deployment has the minimum number of pods available.
+	ConditionDeploymentAvailable = "DeploymentAvailable"
+
+	// ConditionDatabaseReady indicates whether the database is ready to
+	// accept connections.
+	ConditionDatabaseReady = "DatabaseReady"
+
+	// ConditionMediaStorageReady indicates whether the Synapse image
+	// contains the media storage provider configured in spec.media.
+	// It's only present if one is configured.
+	ConditionMediaStorageReady = "MediaStorageReady"
+
+	// ConditionDegraded indicates that the last reconciliation failed,
+	// e.g. because of an invalid spec or an API error.
+	ConditionDegraded = "Degraded"
+)
+
+// Condition contains details for one aspect of the current state of a
+// Synapse resource.
+//
+// It mirrors the metav1.Condition type of newer Kubernetes API machinery
+// releases and is meant to be replaced by it once we depend on them.
+type Condition struct {
+	// Type of condition in CamelCase.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=316
+	Type string `json:"type"`
+
+	// Status of the condition, one of True, False, Unknown.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status metav1.ConditionStatus `json:"status"`
+
+	// ObservedGeneration is the .metadata.generation the condition was
+	// set based upon.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// LastTransitionTime is the last time the condition transitioned
+	// from one status to another.
+	// +kubebuilder:validation:Required
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+
+	// Reason contains a programmatic identifier indicating the reason
+	// for the condition's last transition, in CamelCase.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=1024
+	// +kubebuilder:validation:MinLength=1
+	Reason string `json:"reason"`
+
+	// Message is a human readable message indicating details about the
+	// transition. This may be an empty string.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=32768
+	Message string `json:"message"`
+}
+
+// SetCondition sets the corresponding condition in conditions to
+// newCondition. LastTransitionTime is only updated if the status changes or
+// the condition is new. If it's zero, the current time is used.
+func SetCondition(conditions *[]Condition, newCondition Condition) {
+	if newCondition.LastTransitionTime.IsZero() {
+		newCondition.LastTransitionTime = metav1.Now()
+	}
+
+	existing := FindCondition(*conditions, newCondition.Type)
+	if existing == nil {
+		*conditions = append(*conditions, newCondition)
+		return
+	}
+
+	if existing.Status != newCondition.Status {
+		existing.Status = newCondition.Status
+		existing.LastTransitionTime = newCondition.LastTransitionTime
+	}
+	existing.Reason = newCondition.Reason
+	existing.Message = newCondition.Message
+	existing.ObservedGeneration = newCondition.ObservedGeneration
+}
+
+// RemoveCondition removes the condition of the given type from conditions.
+func RemoveCondition(conditions *[]Condition, conditionType string) {
+	out := (*conditions)[:0]
+	for _, c := range *conditions {
+		if c.Type != conditionType {
+			out = append(out, c)
+		}
+	}
+	*conditions = out
+}
+
+// FindCondition returns the condition of the given type or nil if there is
+// none.
+func FindCondition(conditions []Condition, conditionType string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionTrue reports whether the condition of the given type is
+// present and has status True.
+func IsConditionTrue(conditions []Condition, conditionType string) bool {
+	c := FindCondition(conditions, conditionType)
+	return c != nil && c.Status == metav1.ConditionTrue
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestSetConditionTransitionTime ensures that LastTransitionTime only moves
+// when the condition's status changes.
+func TestSetConditionTransitionTime(t *testing.T) {
+	t0 := metav1.NewTime(time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC))
+	t1 := metav1.NewTime(t0.Add(time.Minute))
+	t2 := metav1.NewTime(t0.Add(2 * time.Minute))
+
+	var conditions []Condition
+	SetCondition(&conditions, Condition{
+		Type:               ConditionConfigReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Creating",
+		LastTransitionTime: t0,
+	})
+	SetCondition(&conditions, Condition{
+		Type:               ConditionConfigReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Outdated",
+		LastTransitionTime: t1,
+	})
+
+	if len(conditions) != 1 {
+		t.Fatalf("expect a single condition, got %d", len(conditions))
+	}
+	c := FindCondition(conditions, ConditionConfigReady)
+	if c.Reason != "Outdated" {
+		t.Errorf("expect reason to be updated to Outdated, got %q", c.Reason)
+	}
+	if !c.LastTransitionTime.Equal(&t0) {
+		t.Errorf("same status: expect LastTransitionTime %v, got %v", t0, c.LastTransitionTime)
+	}
+
+	SetCondition(&conditions, Condition{
+		Type:               ConditionConfigReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "UpToDate",
+		LastTransitionTime: t2,
+	})
+	if !c.LastTransitionTime.Equal(&t2) {
+		t.Errorf("status change: expect LastTransitionTime %v, got %v", t2, c.LastTransitionTime)
+	}
+	if !IsConditionTrue(conditions, ConditionConfigReady) {
+		t.Errorf("expect %s to be true", ConditionConfigReady)
+	}
+	if IsConditionTrue(conditions, ConditionDegraded) {
+		t.Errorf("expect absent %s not to be true", ConditionDegraded)
+	}
+}
+
+func TestRemoveCondition(t *testing.T) {
+	var conditions []Condition
+	RemoveCondition(&conditions, ConditionMediaStorageReady)
+	if conditions != nil {
+		t.Errorf("expect nil conditions, got %v", conditions)
+	}
+
+	for _, typ := range []string{ConditionConfigReady, ConditionMediaStorageReady, ConditionDegraded} {
+		SetCondition(&conditions, Condition{Type: typ, Status: metav1.ConditionTrue})
+	}
+	RemoveCondition(&conditions, ConditionMediaStorageReady)
+	if len(conditions) != 2 || FindCondition(conditions, ConditionMediaStorageReady) != nil {
+		t.Errorf("expect %s to be removed, got %v", ConditionMediaStorageReady, conditions)
+	}
+	if FindCondition(conditions, ConditionDegraded) == nil {
+		t.Errorf("expect %s to be kept", ConditionDegraded)
+	}
+}
@@ -17,7 +17,11 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
 )
 
 // NOTE: json tags are required.  Any new fields you add must have json tags
@@ -38,23 +42,914 @@ type SynapseSpec struct {
 	// specified.
 	// +optional
 	Image string `json:"image,omitempty"`
+
+	// Storage configures a persistent volume for Synapse's data
+	// directory (database, media store, uploads). If unset, an
+	// EmptyDir is used and all data is lost when the pod goes away.
+	// +optional
+	Storage *SynapseStorage `json:"storage,omitempty"`
+
+	// Database configures the database Synapse stores its state in.
+	// Defaults to an SQLite database on the data volume.
+	// +optional
+	Database *SynapseDatabase `json:"database,omitempty"`
+
+	// Expose configures the Service and Ingress through which Synapse
+	// receives client and federation traffic.
+	// +optional
+	Expose *SynapseExpose `json:"expose,omitempty"`
+
+	// Delegation makes Synapse reachable under a different host than
+	// ServerName. The operator serves the corresponding
+	// /.well-known/matrix documents on ServerName.
+	// +optional
+	Delegation *SynapseDelegation `json:"delegation,omitempty"`
+
+	// Workers moves parts of Synapse's workload off the main process
+	// into separate worker processes, one Deployment per worker type.
+	// See https://github.com/matrix-org/synapse/blob/master/docs/workers.md.
+	// Workers replicate through Redis, so Redis must be configured too.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Workers []SynapseWorker `json:"workers,omitempty"`
+
+	// Redis configures the Redis server Synapse uses for replication
+	// between the main process and workers.
+	// +optional
+	Redis *SynapseRedis `json:"redis,omitempty"`
+
+	// ExtraConfig lists ConfigMap or Secret keys holding YAML documents
+	// that are deep-merged, in order, on top of the generated
+	// homeserver.yaml. Nested mappings are merged key by key, null
+	// values remove a setting, listeners, trusted_key_servers and
+	// oidc_providers are merged element by element, other values
+	// replace the generated ones.
+	// +optional
+	ExtraConfig []ExtraConfigSource `json:"extraConfig,omitempty"`
+
+	// ConfigTemplate selects a ConfigMap key holding a Go text/template
+	// used instead of the built-in homeserver.yaml. The template is
+	// executed with the same settings the built-in one uses and may read
+	// Secrets in the Synapse namespace with {{ secret "name" "key" }}.
+	// ExtraConfig is still merged on top of the result.
+	// +optional
+	ConfigTemplate *v1.ConfigMapKeySelector `json:"configTemplate,omitempty"`
+
+	// SigningKey controls the key Synapse signs events and requests
+	// with.
+	// +optional
+	SigningKey *SynapseSigningKey `json:"signingKey,omitempty"`
+
+	// Secrets configures where the signing key and other secrets
+	// Synapse needs come from. By default, they are generated.
+	// +optional
+	Secrets *SynapseSecrets `json:"secrets,omitempty"`
+
+	// Email configures the SMTP server Synapse sends email through,
+	// e.g. for password resets and notifications.
+	// +optional
+	Email *SynapseEmail `json:"email,omitempty"`
+
+	// Turn configures the TURN server Synapse hands out to clients for
+	// VoIP calls.
+	// +optional
+	Turn *SynapseTurn `json:"turn,omitempty"`
+
+	// Media configures where Synapse stores uploaded and cached media.
+	// By default, media lives on the data volume.
+	// +optional
+	Media *SynapseMedia `json:"media,omitempty"`
+
+	// Registration controls who may register accounts. By default,
+	// registration is closed and accounts are created with the shared
+	// secret in the Synapse Secret.
+	// +optional
+	Registration *SynapseRegistration `json:"registration,omitempty"`
+
+	// SSO configures single sign-on.
+	// +optional
+	SSO *SynapseSSO `json:"sso,omitempty"`
+}
+
+// SynapseSecrets configures the contents of the Secret holding Synapse's
+// signing key and other secrets.
+type SynapseSecrets struct {
+	// ExistingSecretName names a Secret in the Synapse namespace whose
+	// values are copied into the Secret managed by the operator when it
+	// is created, e.g. to keep the keys of a migrated homeserver. The
+	// recognized keys are signing-key (contents of Synapse's signing key
+	// file), registration-shared-secret, macaroon-secret-key,
+	// form-secret and old-signing-keys (the old_signing_keys section of
+	// homeserver.yaml). Missing keys are generated.
+	// +optional
+	ExistingSecretName string `json:"existingSecretName,omitempty"`
+
+	// Rotate requests new values for individual secrets. Whenever the
+	// time given for a secret changes, the operator generates a new
+	// value and rolls the Synapse pods.
+	// +optional
+	Rotate *SecretRotation `json:"rotate,omitempty"`
+}
+
+// SecretRotation holds rotation requests for the secrets the operator
+// generates, one timestamp per secret.
+type SecretRotation struct {
+	// RegistrationSharedSecret rotates registration_shared_secret.
+	// +optional
+	RegistrationSharedSecret *metav1.Time `json:"registrationSharedSecret,omitempty"`
+
+	// MacaroonSecretKey rotates macaroon_secret_key. Beware: this
+	// invalidates all existing access tokens, logging out every user.
+	// +optional
+	MacaroonSecretKey *metav1.Time `json:"macaroonSecretKey,omitempty"`
+
+	// FormSecret rotates form_secret.
+	// +optional
+	FormSecret *metav1.Time `json:"formSecret,omitempty"`
+}
+
+// SynapseSigningKey controls rotation of Synapse's signing key.
+type SynapseSigningKey struct {
+	// Rotate requests a new signing key. Whenever it is set to a new
+	// value, the operator generates a new key and keeps publishing the
+	// verify key of the current one through old_signing_keys, so that
+	// other servers can still check events signed with it.
+	// +optional
+	Rotate *metav1.Time `json:"rotate,omitempty"`
+}
+
+// ExtraConfigSource selects a ConfigMap or Secret key in the Synapse
+// namespace. Exactly one of its fields must be set.
+type ExtraConfigSource struct {
+	// ConfigMapKeyRef selects a key of a ConfigMap.
+	// +optional
+	ConfigMapKeyRef *v1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+
+	// SecretKeyRef selects a key of a Secret.
+	// +optional
+	SecretKeyRef *v1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// SynapseStorage describes the persistent volume claim backing a Synapse
+// instance's data directory.
+type SynapseStorage struct {
+	// Size is the requested capacity of the data volume. Defaults to
+	// 10Gi. Increasing it expands the claim if its storage class
+	// allows volume expansion.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName is the storage class used for the claim. Uses
+	// the cluster's default storage class if not specified.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AccessModes for the claim. Defaults to ReadWriteOnce.
+	// +optional
+	AccessModes []v1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// ExistingClaimName refers to a pre-existing persistent volume
+	// claim in the Synapse namespace. If set, the operator uses it
+	// instead of creating its own claim and ignores the other fields.
+	// +optional
+	ExistingClaimName string `json:"existingClaimName,omitempty"`
+}
+
+// SynapseDatabase selects and configures Synapse's database backend.
+type SynapseDatabase struct {
+	// Postgres configures an external PostgreSQL database.
+	// +optional
+	Postgres *PostgresDatabase `json:"postgres,omitempty"`
+
+	// Managed makes the operator deploy and manage a PostgreSQL
+	// database for Synapse. Mutually exclusive with Postgres.
+	// +optional
+	Managed bool `json:"managed,omitempty"`
+
+	// ManagedPostgres tunes the operator-managed database. Only
+	// relevant if Managed is set.
+	// +optional
+	ManagedPostgres *ManagedPostgres `json:"managedPostgres,omitempty"`
+}
+
+// ManagedPostgres holds settings for an operator-managed PostgreSQL
+// database.
+type ManagedPostgres struct {
+	// Image specifies the container image used for running PostgreSQL.
+	// Defaults to "docker.io/library/postgres:13" if not specified.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Size is the requested capacity of the database volume. Defaults
+	// to 10Gi.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName is the storage class used for the database
+	// volume. Uses the cluster's default storage class if not
+	// specified.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
 }
 
+// PostgresDatabase describes how to connect to a PostgreSQL database. The
+// database must have been created with the C collation and UTF8 encoding.
+type PostgresDatabase struct {
+	// Host is the database server's host name or IP address.
+	Host string `json:"host"`
+
+	// Port is the database server's TCP port. Defaults to 5432.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// Database is the name of the database. Defaults to "synapse".
+	// +optional
+	Database string `json:"database,omitempty"`
+
+	// User is the role used for connecting. Defaults to "synapse".
+	// +optional
+	User string `json:"user,omitempty"`
+
+	// PasswordSecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the password for User.
+	PasswordSecretKeyRef v1.SecretKeySelector `json:"passwordSecretKeyRef"`
+}
+
+// SynapseRedis selects the Redis server used by Synapse.
+type SynapseRedis struct {
+	// External configures a Redis server not managed by the operator.
+	// +optional
+	External *ExternalRedis `json:"external,omitempty"`
+
+	// Managed makes the operator deploy and manage a Redis server for
+	// Synapse. Mutually exclusive with External.
+	// +optional
+	Managed bool `json:"managed,omitempty"`
+
+	// ManagedRedis tunes the operator-managed Redis server. Only
+	// relevant if Managed is set.
+	// +optional
+	ManagedRedis *ManagedRedis `json:"managedRedis,omitempty"`
+}
+
+// Enabled reports whether rd selects a Redis server, external or managed.
+func (rd *SynapseRedis) Enabled() bool {
+	return rd != nil && (rd.Managed || rd.External != nil)
+}
+
+// ExternalRedis describes how to connect to a Redis server.
+type ExternalRedis struct {
+	// Host is the Redis server's host name or IP address.
+	Host string `json:"host"`
+
+	// Port is the Redis server's TCP port. Defaults to 6379.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// PasswordSecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the Redis password. No password is used if
+	// unset.
+	// +optional
+	PasswordSecretKeyRef *v1.SecretKeySelector `json:"passwordSecretKeyRef,omitempty"`
+}
+
+// ManagedRedis holds settings for an operator-managed Redis server.
+type ManagedRedis struct {
+	// Image specifies the container image used for running Redis.
+	// Defaults to "docker.io/library/redis:6-alpine" if not specified.
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+// SynapseExpose describes how Synapse is made reachable from outside of its
+// pod.
+type SynapseExpose struct {
+	// ServiceType is the type of the Service in front of Synapse.
+	// Defaults to ClusterIP.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	ServiceType v1.ServiceType `json:"serviceType,omitempty"`
+
+	// ServiceAnnotations are added to the Service.
+	// +optional
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+
+	// Hosts lists the host names the Ingress routes to Synapse. No
+	// Ingress is created if empty.
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+
+	// IngressClassName selects the ingress controller responsible for
+	// the Ingress. Uses the cluster's default if not specified.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// IngressAnnotations are added to the Ingress.
+	// +optional
+	IngressAnnotations map[string]string `json:"ingressAnnotations,omitempty"`
+
+	// TLSSecretName names a Secret holding the TLS certificate for
+	// Hosts. TLS is not configured on the Ingress if empty.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+}
+
+// SynapseDelegation describes where clients and other homeservers find a
+// Synapse instance whose ServerName is delegated to another host.
+type SynapseDelegation struct {
+	// PublicBaseURL is the URL clients use to reach Synapse, e.g.
+	// "https://matrix.example.com/". Published as m.homeserver in
+	// /.well-known/matrix/client and used as Synapse's public_baseurl.
+	// Defaults to "https://<serverName>/".
+	// +optional
+	PublicBaseURL string `json:"publicBaseURL,omitempty"`
+
+	// FederationHost is the host other homeservers connect to for
+	// federation. Published as m.server in /.well-known/matrix/server.
+	// +optional
+	FederationHost string `json:"federationHost,omitempty"`
+
+	// FederationPort is the port other homeservers connect to for
+	// federation. Defaults to 443.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	FederationPort int32 `json:"federationPort,omitempty"`
+
+	// TLSSecretName names a Secret holding the TLS certificate for
+	// ServerName, used by the Ingress serving the .well-known
+	// documents.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+}
+
+// SynapseEmail configures sending email through an SMTP server.
+type SynapseEmail struct {
+	// SMTPHost is the SMTP server's host name or IP address.
+	SMTPHost string `json:"smtpHost"`
+
+	// SMTPPort is the SMTP server's TCP port. Defaults to 465 if
+	// TLSMode is TLS, 25 otherwise.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	SMTPPort int32 `json:"smtpPort,omitempty"`
+
+	// TLSMode selects how the connection to the SMTP server is secured.
+	// Defaults to Opportunistic.
+	// +optional
+	TLSMode EmailTLSMode `json:"tlsMode,omitempty"`
+
+	// UserSecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the SMTP user name. No authentication is done
+	// if unset.
+	// +optional
+	UserSecretKeyRef *v1.SecretKeySelector `json:"userSecretKeyRef,omitempty"`
+
+	// PasswordSecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the SMTP password.
+	// +optional
+	PasswordSecretKeyRef *v1.SecretKeySelector `json:"passwordSecretKeyRef,omitempty"`
+
+	// NotifFrom is the sender address of emails, e.g. "Your Friendly
+	// %(app)s homeserver <noreply@example.com>". It must contain the
+	// %(app)s placeholder, which Synapse replaces with AppName; other
+	// percent signs must be doubled.
+	NotifFrom string `json:"notifFrom"`
+
+	// AppName is the application name used in emails. Defaults to
+	// "Matrix".
+	// +optional
+	AppName string `json:"appName,omitempty"`
+
+	// EnableNotifs makes Synapse send notifications about unread
+	// messages by email.
+	// +optional
+	EnableNotifs bool `json:"enableNotifs,omitempty"`
+}
+
+// EmailTLSMode selects how the connection to an SMTP server is secured.
+// +kubebuilder:validation:Enum=Opportunistic;StartTLS;TLS
+type EmailTLSMode string
+
+const (
+	// EmailTLSOpportunistic uses STARTTLS if the server supports it.
+	EmailTLSOpportunistic EmailTLSMode = "Opportunistic"
+
+	// EmailTLSStartTLS requires STARTTLS.
+	EmailTLSStartTLS EmailTLSMode = "StartTLS"
+
+	// EmailTLSTLS uses TLS from the start (SMTPS). Requires Synapse
+	// 1.79 or later.
+	EmailTLSTLS EmailTLSMode = "TLS"
+)
+
+// SynapseTurn selects the TURN server used by clients for VoIP calls.
+type SynapseTurn struct {
+	// External configures a TURN server not managed by the operator.
+	// +optional
+	External *ExternalTurn `json:"external,omitempty"`
+
+	// Managed makes the operator deploy and manage a coturn server
+	// behind a LoadBalancer Service. Mutually exclusive with External.
+	// +optional
+	Managed bool `json:"managed,omitempty"`
+
+	// ManagedCoturn tunes the operator-managed coturn server. Only
+	// relevant if Managed is set.
+	// +optional
+	ManagedCoturn *ManagedCoturn `json:"managedCoturn,omitempty"`
+
+	// UserLifetime is how long the TURN credentials handed out to
+	// clients stay valid, e.g. "1h". Defaults to Synapse's default.
+	// +optional
+	UserLifetime string `json:"userLifetime,omitempty"`
+
+	// AllowGuests controls whether guest users may use the TURN server.
+	// Defaults to true.
+	// +optional
+	AllowGuests *bool `json:"allowGuests,omitempty"`
+}
+
+// ExternalTurn describes a TURN server using the shared-secret
+// authentication scheme Synapse supports.
+type ExternalTurn struct {
+	// URIs lists the TURN server's URIs handed out to clients, e.g.
+	// "turn:turn.example.com:3478?transport=udp".
+	// +kubebuilder:validation:MinItems=1
+	URIs []string `json:"uris"`
+
+	// SharedSecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the secret shared with the TURN server.
+	SharedSecretKeyRef *v1.SecretKeySelector `json:"sharedSecretKeyRef"`
+}
+
+// ManagedCoturn holds settings for an operator-managed coturn server.
+type ManagedCoturn struct {
+	// Image specifies the container image used for running coturn.
+	// Defaults to "docker.io/coturn/coturn:4.5" if not specified.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// ExternalAddress is the host name or IP address clients use to
+	// reach the TURN server. Defaults to the address assigned to the
+	// LoadBalancer Service.
+	// +optional
+	ExternalAddress string `json:"externalAddress,omitempty"`
+
+	// MinRelayPort and MaxRelayPort delimit the UDP ports used for
+	// relaying media, each of which is exposed on the LoadBalancer
+	// Service. They default to 49160 and 49199; the range may hold at
+	// most 100 ports.
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	MinRelayPort int32 `json:"minRelayPort,omitempty"`
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	MaxRelayPort int32 `json:"maxRelayPort,omitempty"`
+}
+
+// SynapseMedia configures the media repository.
+type SynapseMedia struct {
+	// S3 stores media in an S3-compatible object store using
+	// synapse-s3-storage-provider, which must be installed in the
+	// Synapse image.
+	// +optional
+	S3 *MediaS3 `json:"s3,omitempty"`
+
+	// MaxUploadSize is the largest upload Synapse accepts, a number of
+	// bytes optionally followed by K or M, e.g. "50M".
+	// +kubebuilder:validation:Pattern=`^[0-9]+[KM]?$`
+	// +optional
+	MaxUploadSize string `json:"maxUploadSize,omitempty"`
+
+	// Retention configures when media is purged. By default, media is
+	// kept forever.
+	// +optional
+	Retention *MediaRetention `json:"retention,omitempty"`
+
+	// ThumbnailSizes lists the thumbnails generated for uploaded
+	// images. Defaults to Synapse's list.
+	// +optional
+	ThumbnailSizes []ThumbnailSize `json:"thumbnailSizes,omitempty"`
+
+	// URLPreview enables generating previews of URLs posted in rooms.
+	// Synapse fetches the URLs itself, so requests to the addresses in
+	// IPRangeBlacklist are refused.
+	// +optional
+	URLPreview *URLPreview `json:"urlPreview,omitempty"`
+}
+
+// MediaRetention configures the lifetime of media, as a number followed by
+// one of the units ms, s, m, h, d, w or y, e.g. "90d".
+type MediaRetention struct {
+	// LocalMediaLifetime is how long media uploaded by local users is
+	// kept after it was last accessed.
+	// +optional
+	LocalMediaLifetime string `json:"localMediaLifetime,omitempty"`
+
+	// RemoteMediaLifetime is how long media cached from other servers
+	// is kept after it was last accessed.
+	// +optional
+	RemoteMediaLifetime string `json:"remoteMediaLifetime,omitempty"`
+}
+
+// ThumbnailSize describes a thumbnail generated for uploaded images.
+type ThumbnailSize struct {
+	// +kubebuilder:validation:Minimum=1
+	Width int32 `json:"width"`
+	// +kubebuilder:validation:Minimum=1
+	Height int32 `json:"height"`
+	// Method is either crop, producing exactly Width×Height, or scale,
+	// preserving the aspect ratio within those bounds.
+	// +kubebuilder:validation:Enum=crop;scale
+	Method string `json:"method"`
+}
+
+// URLPreview configures URL previews.
+type URLPreview struct {
+	// IPRangeBlacklist lists the address ranges, in CIDR notation,
+	// Synapse won't fetch previews from. Defaults to the loopback,
+	// private and link-local ranges also blocked for federation.
+	// +optional
+	IPRangeBlacklist []string `json:"ipRangeBlacklist,omitempty"`
+
+	// IPRangeWhitelist lists exceptions to IPRangeBlacklist.
+	// +optional
+	IPRangeWhitelist []string `json:"ipRangeWhitelist,omitempty"`
+
+	// MaxSpiderSize is the largest document fetched for a preview,
+	// e.g. "10M".
+	// +kubebuilder:validation:Pattern=`^[0-9]+[KM]?$`
+	// +optional
+	MaxSpiderSize string `json:"maxSpiderSize,omitempty"`
+}
+
+// MediaS3 describes an S3 bucket to store media in.
+type MediaS3 struct {
+	// Bucket is the name of the bucket.
+	Bucket string `json:"bucket"`
+
+	// EndpointURL is the URL of the S3-compatible service, e.g.
+	// "http://minio.minio.svc:9000". Defaults to AWS.
+	// +optional
+	EndpointURL string `json:"endpointURL,omitempty"`
+
+	// Region is the region the bucket is located in.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// AccessKeyIDSecretKeyRef and SecretAccessKeySecretKeyRef select
+	// the keys of Secrets in the Synapse namespace holding the
+	// credentials for the bucket. If unset, the default credential
+	// chain of boto3 is used, e.g. AWS_* environment variables or an
+	// instance profile.
+	// +optional
+	AccessKeyIDSecretKeyRef *v1.SecretKeySelector `json:"accessKeyIDSecretKeyRef,omitempty"`
+	// +optional
+	SecretAccessKeySecretKeyRef *v1.SecretKeySelector `json:"secretAccessKeySecretKeyRef,omitempty"`
+
+	// StoreLocal keeps the local media store on the data volume. If
+	// false, it's an emptyDir volume serving as a cache. It doesn't map
+	// to the provider's store_local setting: Synapse always writes media
+	// to the local store first, and the provider copies every file to
+	// the bucket regardless. Defaults to true.
+	// +optional
+	StoreLocal *bool `json:"storeLocal,omitempty"`
+}
+
+// SynapseRegistration configures registering new accounts.
+type SynapseRegistration struct {
+	// Enabled opens registration to anyone able to pass the checks
+	// configured below.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// EnableWithoutVerification acknowledges that open registration
+	// without reCAPTCHA, third-party ID verification or registration
+	// tokens invites spam. Synapse refuses to start without it in that
+	// case.
+	// +optional
+	EnableWithoutVerification bool `json:"enableWithoutVerification,omitempty"`
+
+	// RequiredThreepids lists the third-party IDs new users have to
+	// verify. Email verification requires spec.email, msisdn needs a
+	// delegate configured through ExtraConfig.
+	// +listType=set
+	// +optional
+	RequiredThreepids []ThreepidMedium `json:"requiredThreepids,omitempty"`
+
+	// RequireToken requires a registration token, created through the
+	// Synapse admin API, to register.
+	// +optional
+	RequireToken bool `json:"requireToken,omitempty"`
+
+	// AutoJoinRooms lists the aliases of rooms new users join, e.g.
+	// "#welcome:example.com".
+	// +optional
+	AutoJoinRooms []string `json:"autoJoinRooms,omitempty"`
+
+	// Recaptcha requires solving a Google reCAPTCHA to register.
+	// +optional
+	Recaptcha *RegistrationRecaptcha `json:"recaptcha,omitempty"`
+}
+
+// ThreepidMedium is a kind of third-party ID.
+// +kubebuilder:validation:Enum=email;msisdn
+type ThreepidMedium string
+
+const (
+	// ThreepidEmail is an email address.
+	ThreepidEmail ThreepidMedium = "email"
+
+	// ThreepidMSISDN is a phone number.
+	ThreepidMSISDN ThreepidMedium = "msisdn"
+)
+
+// RegistrationRecaptcha holds the reCAPTCHA keys of the site.
+type RegistrationRecaptcha struct {
+	// PublicKeySecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the reCAPTCHA site key.
+	PublicKeySecretKeyRef *v1.SecretKeySelector `json:"publicKeySecretKeyRef"`
+
+	// PrivateKeySecretKeyRef selects the key of a Secret in the Synapse
+	// namespace holding the reCAPTCHA secret key.
+	PrivateKeySecretKeyRef *v1.SecretKeySelector `json:"privateKeySecretKeyRef"`
+}
+
+// SynapseConfig returns the registration settings in the form understood
+// by synapseconf, except for the reCAPTCHA keys, which the caller has to
+// read from the Secrets selected by Recaptcha.
+func (reg *SynapseRegistration) SynapseConfig() *synapseconf.RegistrationConfig {
+	c := &synapseconf.RegistrationConfig{
+		Enabled:                   reg.Enabled,
+		EnableWithoutVerification: reg.EnableWithoutVerification,
+		RequireToken:              reg.RequireToken,
+		AutoJoinRooms:             reg.AutoJoinRooms,
+	}
+	for _, m := range reg.RequiredThreepids {
+		c.RequiredThreepids = append(c.RequiredThreepids, string(m))
+	}
+	return c
+}
+
+// SynapseSSO configures single sign-on.
+type SynapseSSO struct {
+	// OIDCProviders lists the OpenID Connect providers users can log in
+	// through.
+	// +listType=map
+	// +listMapKey=id
+	// +optional
+	OIDCProviders []OIDCProvider `json:"oidcProviders,omitempty"`
+}
+
+// OIDCProvider describes an OpenID Connect provider, e.g. a Keycloak
+// realm.
+type OIDCProvider struct {
+	// ID identifies the provider, e.g. in the URLs of the login flow.
+	// Changing it breaks the link to existing users.
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9._~-]+$`
+	// +kubebuilder:validation:MaxLength=250
+	ID string `json:"id"`
+
+	// Name is the provider name shown to users.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Issuer is the provider's issuer URL, which must use https, e.g.
+	// "https://keycloak.example.com/realms/example".
+	Issuer string `json:"issuer"`
+
+	// ClientID is the OAuth2 client ID registered for Synapse.
+	ClientID string `json:"clientID"`
+
+	// ClientSecretSecretKeyRef selects the key of a Secret in the
+	// Synapse namespace holding the OAuth2 client secret.
+	// +optional
+	ClientSecretSecretKeyRef *v1.SecretKeySelector `json:"clientSecretSecretKeyRef,omitempty"`
+
+	// Scopes lists the OAuth2 scopes to request. Must include openid.
+	// Defaults to openid only.
+	// +optional
+	Scopes []string `json:"scopes,omitempty"`
+
+	// UserMapping derives the attributes of new users from the claims
+	// of the ID token.
+	// +optional
+	UserMapping *OIDCUserMapping `json:"userMapping,omitempty"`
+}
+
+// OIDCUserMapping holds Jinja2 templates evaluated with the ID token
+// claims available as user, e.g. "{{ user.preferred_username }}".
+type OIDCUserMapping struct {
+	// LocalpartTemplate yields the localpart of the Matrix ID.
+	// +optional
+	LocalpartTemplate string `json:"localpartTemplate,omitempty"`
+
+	// DisplayNameTemplate yields the display name.
+	// +optional
+	DisplayNameTemplate string `json:"displayNameTemplate,omitempty"`
+
+	// EmailTemplate yields an email address added to the account.
+	// +optional
+	EmailTemplate string `json:"emailTemplate,omitempty"`
+}
+
+// SynapseConfig returns the provider in the form understood by
+// synapseconf, except for the client secret, which the caller has to read
+// from the Secret selected by ClientSecretSecretKeyRef.
+func (p *OIDCProvider) SynapseConfig() synapseconf.OIDCProviderConfig {
+	c := synapseconf.OIDCProviderConfig{
+		ID:       p.ID,
+		Name:     p.Name,
+		Issuer:   p.Issuer,
+		ClientID: p.ClientID,
+		Scopes:   p.Scopes,
+	}
+	if um := p.UserMapping; um != nil {
+		c.LocalpartTemplate = um.LocalpartTemplate
+		c.DisplayNameTemplate = um.DisplayNameTemplate
+		c.EmailTemplate = um.EmailTemplate
+	}
+	return c
+}
+
+// SynapseWorkerType names a kind of Synapse worker process.
+// +kubebuilder:validation:Enum=generic;federation_sender;media;pusher;appservice
+type SynapseWorkerType string
+
+const (
+	// WorkerGeneric serves a subset of the client and federation APIs,
+	// e.g. sync and inbound federation transactions.
+	WorkerGeneric SynapseWorkerType = "generic"
+
+	// WorkerFederationSender sends outbound federation traffic.
+	WorkerFederationSender SynapseWorkerType = "federation_sender"
+
+	// WorkerMedia serves the media repository. All media workers and
+	// the main process must share the data volume, which thus needs
+	// to support the ReadWriteMany access mode.
+	WorkerMedia SynapseWorkerType = "media"
+
+	// WorkerPusher sends push notifications.
+	WorkerPusher SynapseWorkerType = "pusher"
+
+	// WorkerAppservice sends events to application services.
+	WorkerAppservice SynapseWorkerType = "appservice"
+)
+
+// Singleton reports whether Synapse supports at most one process of
+// workers of type t.
+func (t SynapseWorkerType) Singleton() bool {
+	switch t {
+	case WorkerFederationSender, WorkerPusher, WorkerAppservice:
+		return true
+	}
+	return false
+}
+
+// SynapseWorker describes the worker processes of one type.
+type SynapseWorker struct {
+	// Type of the worker processes.
+	Type SynapseWorkerType `json:"type"`
+
+	// Replicas is the number of worker processes. Only generic and
+	// media workers can run more than one replica. If unset, the
+	// operator doesn't manage the replica count, e.g. to leave it to a
+	// HorizontalPodAutoscaler. New Deployments start with one replica.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+}
+
+// SynapsePhase summarizes the state of a Synapse instance.
+type SynapsePhase string
+
+const (
+	// SynapsePending means Synapse isn't available yet, e.g. because
+	// its resources are still being created.
+	SynapsePending SynapsePhase = "Pending"
+
+	// SynapseRunning means the Synapse Deployment is available.
+	SynapseRunning SynapsePhase = "Running"
+
+	// SynapseDegraded means the last reconciliation failed.
+	SynapseDegraded SynapsePhase = "Degraded"
+)
+
 // SynapseStatus defines the observed state of Synapse
 type SynapseStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
+	// ObservedGeneration is the most recent generation of the Synapse
+	// resource reconciled by the operator.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Phase summarizes the conditions below.
+	// +optional
+	Phase SynapsePhase `json:"phase,omitempty"`
+
+	// Conditions describe the current state of the Synapse instance.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+
 	// ConfigMapName is the name of the K8s config map holding the
 	// homeserver configuration file(s)
 	ConfigMapName string `json:"configMapName,omitempty"`
 
+	// TemplateSecrets lists the Secrets spec.configTemplate read when
+	// homeserver.yaml was last generated. Changes to them regenerate the
+	// file.
+	// +optional
+	TemplateSecrets []string `json:"templateSecrets,omitempty"`
+
 	// SecretName is the name of the K8s secret storing the server's
 	// signing key as well as other secrets used by synapse.
 	SecretName string `json:"secretName,omitempty"`
+
+	// Storage reports the state of the data volume claim, if any.
+	// +optional
+	Storage *StorageStatus `json:"storage,omitempty"`
+
+	// Database reports the state of the operator-managed database, if
+	// any.
+	// +optional
+	Database *DatabaseStatus `json:"database,omitempty"`
+
+	// SigningKey reports the signing key currently in use.
+	// +optional
+	SigningKey *SigningKeyStatus `json:"signingKey,omitempty"`
+
+	// SecretRotations reports the last rotation of each secret rotated
+	// through spec.secrets.rotate.
+	// +listType=map
+	// +listMapKey=key
+	// +optional
+	SecretRotations []SecretRotationStatus `json:"secretRotations,omitempty"`
+}
+
+// SecretRotationStatus records the last rotation of a secret.
+type SecretRotationStatus struct {
+	// Key is the key of the rotated secret in the Synapse Secret, e.g.
+	// macaroon-secret-key.
+	Key string `json:"key"`
+
+	// LastRotation is when the operator last regenerated the secret.
+	LastRotation metav1.Time `json:"lastRotation"`
+}
+
+// SigningKeyStatus describes the signing key currently in use.
+type SigningKeyStatus struct {
+	// KeyID identifies the key, e.g. ed25519:a_AbCd.
+	KeyID string `json:"keyID"`
+
+	// LastRotation is when the key replaced the previous one, if it
+	// was rotated. The previous key expired at this time.
+	// +optional
+	LastRotation *metav1.Time `json:"lastRotation,omitempty"`
+}
+
+// DatabaseStatus describes the observed state of an operator-managed
+// database.
+type DatabaseStatus struct {
+	// Host is the address Synapse uses to connect to the database.
+	Host string `json:"host"`
+
+	// Ready is true once the database accepts connections.
+	Ready bool `json:"ready"`
+}
+
+// StorageStatus describes the observed state of the data volume claim.
+type StorageStatus struct {
+	// ClaimName is the name of the persistent volume claim mounted at
+	// /data.
+	ClaimName string `json:"claimName"`
+
+	// Phase is the claim's current phase (Pending, Bound or Lost).
+	// +optional
+	Phase v1.PersistentVolumeClaimPhase `json:"phase,omitempty"`
+
+	// Capacity is the actual capacity of the bound volume.
+	// +optional
+	Capacity *resource.Quantity `json:"capacity,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Server Name",type=string,JSONPath=`.spec.serverName`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.conditions[?(@.type=="DeploymentAvailable")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Synapse is the Schema for the synapsis API
 type Synapse struct {
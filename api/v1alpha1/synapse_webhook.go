@@ -0,0 +1,364 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+const (
+	// DefaultImage is the Synapse container image used if the spec
+	// doesn't name one.
+	DefaultImage = "docker.io/matrixdotorg/synapse:latest"
+
+	// DefaultPostgresImage is the container image used for an
+	// operator-managed PostgreSQL database if the spec doesn't name one.
+	DefaultPostgresImage = "docker.io/library/postgres:13"
+
+	// DefaultRedisImage is the container image used for an
+	// operator-managed Redis server if the spec doesn't name one.
+	DefaultRedisImage = "docker.io/library/redis:6-alpine"
+
+	// DefaultCoturnImage is the container image used for an
+	// operator-managed coturn server if the spec doesn't name one.
+	DefaultCoturnImage = "docker.io/coturn/coturn:4.5"
+
+	// DefaultMinRelayPort and DefaultMaxRelayPort delimit the UDP ports
+	// an operator-managed coturn server relays media on if the spec
+	// doesn't name them.
+	DefaultMinRelayPort = 49160
+	DefaultMaxRelayPort = 49199
+
+	// MaxRelayPorts is the maximum number of relay ports of an
+	// operator-managed coturn server, each needing a Service port.
+	MaxRelayPorts = 100
+
+	// DefaultPostgresPort is the TCP port used to connect to an external
+	// PostgreSQL database if the spec doesn't name one.
+	DefaultPostgresPort = 5432
+
+	// DefaultFederationPort is the port advertised in the
+	// /.well-known/matrix/server document if the spec doesn't name one.
+	DefaultFederationPort = 443
+)
+
+// log is for logging in this package.
+var synapselog = logf.Log.WithName("synapse-resource")
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks
+// for Synapse resources with mgr.
+func (r *Synapse) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-matrix-slrz-net-v1alpha1-synapse,mutating=true,failurePolicy=fail,groups=matrix.slrz.net,resources=synapsis,verbs=create;update,versions=v1alpha1,name=msynapse.kb.io
+
+var _ webhook.Defaulter = &Synapse{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for
+// the type.
+func (r *Synapse) Default() {
+	synapselog.Info("default", "name", r.Name)
+
+	if r.Spec.Image == "" {
+		r.Spec.Image = DefaultImage
+	}
+	if db := r.Spec.Database; db != nil {
+		if db.Managed {
+			if db.ManagedPostgres == nil {
+				db.ManagedPostgres = &ManagedPostgres{}
+			}
+			if db.ManagedPostgres.Image == "" {
+				db.ManagedPostgres.Image = DefaultPostgresImage
+			}
+		}
+		if db.Postgres != nil && db.Postgres.Port == 0 {
+			db.Postgres.Port = DefaultPostgresPort
+		}
+	}
+	if rd := r.Spec.Redis; rd != nil && rd.Managed {
+		if rd.ManagedRedis == nil {
+			rd.ManagedRedis = &ManagedRedis{}
+		}
+		if rd.ManagedRedis.Image == "" {
+			rd.ManagedRedis.Image = DefaultRedisImage
+		}
+	}
+	if tu := r.Spec.Turn; tu != nil && tu.Managed {
+		if tu.ManagedCoturn == nil {
+			tu.ManagedCoturn = &ManagedCoturn{}
+		}
+		if tu.ManagedCoturn.Image == "" {
+			tu.ManagedCoturn.Image = DefaultCoturnImage
+		}
+		if tu.ManagedCoturn.MinRelayPort == 0 {
+			tu.ManagedCoturn.MinRelayPort = DefaultMinRelayPort
+		}
+		if tu.ManagedCoturn.MaxRelayPort == 0 {
+			tu.ManagedCoturn.MaxRelayPort = DefaultMaxRelayPort
+		}
+	}
+	if d := r.Spec.Delegation; d != nil && d.FederationHost != "" && d.FederationPort == 0 {
+		d.FederationPort = DefaultFederationPort
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-matrix-slrz-net-v1alpha1-synapse,mutating=false,failurePolicy=fail,groups=matrix.slrz.net,resources=synapsis,versions=v1alpha1,name=vsynapse.kb.io
+
+var _ webhook.Validator = &Synapse{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be
+// registered for the type.
+func (r *Synapse) ValidateCreate() error {
+	synapselog.Info("validate create", "name", r.Name)
+
+	return r.toInvalidError(r.validateSpec())
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be
+// registered for the type.
+func (r *Synapse) ValidateUpdate(old runtime.Object) error {
+	synapselog.Info("validate update", "name", r.Name)
+
+	allErrs := r.validateSpec()
+	o, ok := old.(*Synapse)
+	if !ok {
+		return r.toInvalidError(allErrs)
+	}
+	// Synapse stores the server name in its database and refuses to
+	// start if it doesn't match the configured one.
+	if o.Spec.ServerName != r.Spec.ServerName {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "serverName"),
+			"field is immutable: Synapse cannot change the server name of an existing database"))
+	}
+	// The managed database's volume comes from the volume claim template
+	// of its StatefulSet, which can't be changed.
+	if oldDB, db := o.Spec.Database, r.Spec.Database; oldDB != nil && db != nil &&
+		oldDB.ManagedPostgres != nil && db.ManagedPostgres != nil {
+		path := field.NewPath("spec", "database", "managedPostgres")
+		if !apiequality.Semantic.DeepEqual(oldDB.ManagedPostgres.Size, db.ManagedPostgres.Size) {
+			allErrs = append(allErrs, field.Forbidden(path.Child("size"),
+				"field is immutable: the database volume can't be resized"))
+		}
+		if !apiequality.Semantic.DeepEqual(oldDB.ManagedPostgres.StorageClassName, db.ManagedPostgres.StorageClassName) {
+			allErrs = append(allErrs, field.Forbidden(path.Child("storageClassName"),
+				"field is immutable: the database volume can't be moved"))
+		}
+	}
+	return r.toInvalidError(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be
+// registered for the type.
+func (r *Synapse) ValidateDelete() error {
+	return nil
+}
+
+func (r *Synapse) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if err := validateServerName(r.Spec.ServerName); err != "" {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("serverName"),
+			r.Spec.ServerName, err))
+	}
+	if r.Spec.Image != "" && !isImageReference(r.Spec.Image) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("image"),
+			r.Spec.Image, "not a valid image reference"))
+	}
+	if db := r.Spec.Database; db != nil && db.ManagedPostgres != nil {
+		if img := db.ManagedPostgres.Image; img != "" && !isImageReference(img) {
+			allErrs = append(allErrs, field.Invalid(
+				specPath.Child("database", "managedPostgres", "image"),
+				img, "not a valid image reference"))
+		}
+	}
+	if rd := r.Spec.Redis; rd != nil && rd.ManagedRedis != nil {
+		if img := rd.ManagedRedis.Image; img != "" && !isImageReference(img) {
+			allErrs = append(allErrs, field.Invalid(
+				specPath.Child("redis", "managedRedis", "image"),
+				img, "not a valid image reference"))
+		}
+	}
+	if tu := r.Spec.Turn; tu != nil {
+		if tu.Managed && tu.External != nil {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("turn", "external"),
+				"turn.managed and turn.external are mutually exclusive"))
+		}
+		if mc := tu.ManagedCoturn; mc != nil {
+			if mc.Image != "" && !isImageReference(mc.Image) {
+				allErrs = append(allErrs, field.Invalid(
+					specPath.Child("turn", "managedCoturn", "image"),
+					mc.Image, "not a valid image reference"))
+			}
+			if mc.MinRelayPort != 0 && mc.MaxRelayPort != 0 {
+				if mc.MinRelayPort > mc.MaxRelayPort {
+					allErrs = append(allErrs, field.Invalid(
+						specPath.Child("turn", "managedCoturn", "maxRelayPort"),
+						mc.MaxRelayPort, "must not be less than minRelayPort"))
+				} else if mc.MaxRelayPort-mc.MinRelayPort+1 > MaxRelayPorts {
+					allErrs = append(allErrs, field.Invalid(
+						specPath.Child("turn", "managedCoturn", "maxRelayPort"),
+						mc.MaxRelayPort, fmt.Sprintf("relay port range must not hold more than %d ports", MaxRelayPorts)))
+				}
+			}
+		}
+	}
+	if reg := r.Spec.Registration; reg != nil {
+		c := reg.SynapseConfig()
+		if rc := reg.Recaptcha; rc != nil {
+			// The keys are in Secrets we can't read here, so
+			// validate with stand-ins for those referenced.
+			if rc.PublicKeySecretKeyRef != nil {
+				c.RecaptchaPublicKey = "public-key"
+			}
+			if rc.PrivateKeySecretKeyRef != nil {
+				c.RecaptchaPrivateKey = "private-key"
+			}
+		}
+		if err := synapseconf.ValidateRegistrationConfig(c); err != nil {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("registration"), err.Error()))
+		}
+	}
+	if len(r.Spec.Workers) > 0 && !r.Spec.Redis.Enabled() {
+		allErrs = append(allErrs, field.Required(specPath.Child("redis"),
+			"workers need Redis for replication"))
+	}
+	if sso := r.Spec.SSO; sso != nil {
+		// Validating ever longer prefixes of the list attributes
+		// each error to the first provider causing it.
+		var providers []synapseconf.OIDCProviderConfig
+		for i, p := range sso.OIDCProviders {
+			providers = append(providers, p.SynapseConfig())
+			if err := synapseconf.ValidateOIDCProviders(providers); err != nil {
+				allErrs = append(allErrs, field.Invalid(
+					specPath.Child("sso", "oidcProviders").Index(i),
+					p.ID, err.Error()))
+				break
+			}
+		}
+	}
+	for i, w := range r.Spec.Workers {
+		if w.Type.Singleton() && w.Replicas != nil && *w.Replicas > 1 {
+			allErrs = append(allErrs, field.Invalid(
+				specPath.Child("workers").Index(i).Child("replicas"),
+				*w.Replicas, "must not be greater than 1 for "+string(w.Type)+" workers"))
+		}
+	}
+	return allErrs
+}
+
+func (r *Synapse) toInvalidError(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Synapse").GroupKind(),
+		r.Name, allErrs)
+}
+
+// ValidateServerName checks that s is a valid Matrix server name: a DNS name
+// or IP literal, optionally followed by a port. It returns a description of
+// the problem or the empty string if s is fine.
+func validateServerName(s string) string {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return "missing ']' in IPv6 literal"
+		}
+		host = s[1:end]
+		rest := s[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return "unexpected characters after IPv6 literal"
+			}
+			port = rest[1:]
+			if port == "" {
+				return "empty port"
+			}
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return "not a valid IPv6 literal"
+		}
+	} else {
+		if i := strings.LastIndexByte(s, ':'); i >= 0 {
+			host, port = s[:i], s[i+1:]
+			if port == "" {
+				return "empty port"
+			}
+		}
+		if host == "" {
+			return "must not be empty"
+		}
+		if net.ParseIP(host) == nil {
+			if errs := validation.IsDNS1123Subdomain(host); len(errs) > 0 {
+				return strings.Join(errs, "; ")
+			}
+		}
+	}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return "port must be a number"
+		}
+		if errs := validation.IsValidPortNum(n); len(errs) > 0 {
+			return "port " + strings.Join(errs, "; ")
+		}
+	}
+	return ""
+}
+
+// ImageReferenceRegexp matches container image references of the form
+// [domain[:port]/]path[:tag][@digest], following the grammar used by
+// docker/distribution.
+var imageReferenceRegexp = func() *regexp.Regexp {
+	const (
+		alphaNumeric    = `[a-z0-9]+`
+		separator       = `(?:[._]|__|[-]*)`
+		nameComponent   = alphaNumeric + `(?:` + separator + alphaNumeric + `)*`
+		domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+		domain          = domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?`
+		name            = `(?:` + domain + `/)?` + nameComponent + `(?:/` + nameComponent + `)*`
+		tag             = `[\w][\w.-]{0,127}`
+		digest          = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	)
+	return regexp.MustCompile(`^(` + name + `)(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// IsImageReference reports whether s is a well-formed container image
+// reference.
+func isImageReference(s string) bool {
+	m := imageReferenceRegexp.FindStringSubmatch(s)
+	return m != nil && len(m[1]) <= 255
+}
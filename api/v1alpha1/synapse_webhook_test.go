@@ -0,0 +1,359 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+func TestDefault(t *testing.T) {
+	r := &Synapse{
+		Spec: SynapseSpec{
+			ServerName: "example.com",
+			Database:   &SynapseDatabase{Managed: true},
+			Delegation: &SynapseDelegation{FederationHost: "matrix.example.com"},
+		},
+	}
+	r.Default()
+
+	if r.Spec.Image != DefaultImage {
+		t.Errorf("expect image %q, got %q", DefaultImage, r.Spec.Image)
+	}
+	if mp := r.Spec.Database.ManagedPostgres; mp == nil || mp.Image != DefaultPostgresImage {
+		t.Errorf("expect managed postgres image %q, got %+v", DefaultPostgresImage, mp)
+	}
+	if p := r.Spec.Delegation.FederationPort; p != DefaultFederationPort {
+		t.Errorf("expect federation port %d, got %d", DefaultFederationPort, p)
+	}
+
+	r.Spec.Image = "registry.example.com/synapse:v1.14.0"
+	r.Default()
+	if r.Spec.Image != "registry.example.com/synapse:v1.14.0" {
+		t.Errorf("Default overwrote image: got %q", r.Spec.Image)
+	}
+}
+
+func TestValidateServerName(t *testing.T) {
+	tests := []struct {
+		serverName string
+		valid      bool
+	}{
+		{"example.com", true},
+		{"matrix.example.com:8448", true},
+		{"localhost", true},
+		{"1.2.3.4", true},
+		{"1.2.3.4:8448", true},
+		{"[::1]", true},
+		{"[2001:db8::1]:8448", true},
+		{"", false},
+		{"Example.com", false},
+		{"example.com:", false},
+		{"example.com:http", false},
+		{"example.com:65536", false},
+		{"example.com:0", false},
+		{"-example.com", false},
+		{"exa mple.com", false},
+		{"https://example.com", false},
+		{"[::1", false},
+		{"[::1]x", false},
+		{"[1.2.3.4]", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		msg := validateServerName(tt.serverName)
+		if valid := msg == ""; valid != tt.valid {
+			t.Errorf("validateServerName(%q): expect valid=%t, got %q", tt.serverName, tt.valid, msg)
+		}
+	}
+}
+
+func TestIsImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		valid bool
+	}{
+		{"synapse", true},
+		{"matrixdotorg/synapse", true},
+		{"matrixdotorg/synapse:v1.14.0", true},
+		{"docker.io/matrixdotorg/synapse:latest", true},
+		{"localhost:5000/synapse", true},
+		{"registry.example.com:5000/matrix/synapse:v1.14.0-py3", true},
+		{"synapse@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+		{"synapse:v1@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+		{"", false},
+		{"Synapse", false},
+		{"synapse:", false},
+		{"synapse:-latest", false},
+		{"synapse@sha256:abc", false},
+		{"docker.io/matrixdotorg/synapse latest", false},
+		{"https://docker.io/matrixdotorg/synapse", false},
+		{"/synapse", false},
+	}
+	for _, tt := range tests {
+		if got := isImageReference(tt.image); got != tt.valid {
+			t.Errorf("isImageReference(%q): expect %t, got %t", tt.image, tt.valid, got)
+		}
+	}
+}
+
+func TestValidateUpdateServerNameImmutable(t *testing.T) {
+	old := &Synapse{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec:       SynapseSpec{ServerName: "example.com"},
+	}
+	r := old.DeepCopy()
+	r.Spec.Image = "matrixdotorg/synapse:v1.14.0"
+	if err := r.ValidateUpdate(old); err != nil {
+		t.Errorf("unchanged serverName: unexpected error: %v", err)
+	}
+
+	r.Spec.ServerName = "example.org"
+	if err := r.ValidateUpdate(old); err == nil {
+		t.Error("changed serverName: expect error, got nil")
+	}
+}
+
+func TestValidateUpdateManagedPostgresVolume(t *testing.T) {
+	size := resource.MustParse("10Gi")
+	old := &Synapse{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: SynapseSpec{
+			ServerName: "example.com",
+			Database: &SynapseDatabase{
+				Managed:         true,
+				ManagedPostgres: &ManagedPostgres{Size: &size},
+			},
+		},
+	}
+	r := old.DeepCopy()
+	r.Spec.Database.ManagedPostgres.Image = "postgres:13.1"
+	if err := r.ValidateUpdate(old); err != nil {
+		t.Errorf("changed image: unexpected error: %v", err)
+	}
+
+	bigger := resource.MustParse("20Gi")
+	r.Spec.Database.ManagedPostgres.Size = &bigger
+	if err := r.ValidateUpdate(old); err == nil {
+		t.Error("changed size: expect error, got nil")
+	}
+
+	r = old.DeepCopy()
+	class := "fast"
+	r.Spec.Database.ManagedPostgres.StorageClassName = &class
+	if err := r.ValidateUpdate(old); err == nil {
+		t.Error("changed storage class: expect error, got nil")
+	}
+}
+
+func TestValidateCreate(t *testing.T) {
+	r := &Synapse{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: SynapseSpec{
+			ServerName: "example.com",
+			Image:      "matrixdotorg/synapse:v1.14.0",
+		},
+	}
+	if err := r.ValidateCreate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	r.Spec.Database = &SynapseDatabase{
+		Managed:         true,
+		ManagedPostgres: &ManagedPostgres{Image: "postgres:13 "},
+	}
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("malformed managed postgres image: expect error, got nil")
+	}
+}
+
+func TestValidateCreateTurn(t *testing.T) {
+	r := &Synapse{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: SynapseSpec{
+			ServerName: "example.com",
+			Turn:       &SynapseTurn{Managed: true},
+		},
+	}
+	r.Default()
+	if err := r.ValidateCreate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if mc := r.Spec.Turn.ManagedCoturn; mc.MinRelayPort != DefaultMinRelayPort || mc.MaxRelayPort != DefaultMaxRelayPort {
+		t.Errorf("expect default relay ports %d-%d, got %d-%d",
+			DefaultMinRelayPort, DefaultMaxRelayPort, mc.MinRelayPort, mc.MaxRelayPort)
+	}
+
+	r.Spec.Turn.ManagedCoturn.MaxRelayPort = r.Spec.Turn.ManagedCoturn.MinRelayPort + MaxRelayPorts
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("oversized relay port range: expect error, got nil")
+	}
+
+	r.Spec.Turn.ManagedCoturn.MaxRelayPort = DefaultMaxRelayPort
+	r.Spec.Turn.External = &ExternalTurn{URIs: []string{"turn:turn.example.com"}}
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("managed and external TURN: expect error, got nil")
+	}
+}
+
+func TestValidateCreateRegistration(t *testing.T) {
+	r := &Synapse{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: SynapseSpec{
+			ServerName:   "example.com",
+			Registration: &SynapseRegistration{Enabled: true},
+		},
+	}
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("open registration without verification: expect error, got nil")
+	}
+
+	r.Spec.Registration.EnableWithoutVerification = true
+	if err := r.ValidateCreate(); err != nil {
+		t.Errorf("acknowledged open registration: unexpected error: %v", err)
+	}
+
+	r.Spec.Registration.EnableWithoutVerification = false
+	r.Spec.Registration.RequiredThreepids = []ThreepidMedium{ThreepidEmail}
+	if err := r.ValidateCreate(); err != nil {
+		t.Errorf("email verification: unexpected error: %v", err)
+	}
+
+	r.Spec.Registration.RequiredThreepids = nil
+	r.Spec.Registration.Recaptcha = &RegistrationRecaptcha{
+		PublicKeySecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "recaptcha"},
+			Key:                  "site-key",
+		},
+		PrivateKeySecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "recaptcha"},
+			Key:                  "secret-key",
+		},
+	}
+	if err := r.ValidateCreate(); err != nil {
+		t.Errorf("reCAPTCHA: unexpected error: %v", err)
+	}
+
+	r.Spec.Registration.AutoJoinRooms = []string{"welcome"}
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("auto-join room without alias: expect error, got nil")
+	}
+}
+
+// TestValidateCreateOIDCProviders ensures that the webhook rejects the
+// same providers as the synapseconf validation done by the controller.
+func TestValidateCreateOIDCProviders(t *testing.T) {
+	valid := OIDCProvider{
+		ID:       "keycloak",
+		Issuer:   "https://keycloak.example.com/realms/example",
+		ClientID: "synapse",
+	}
+	tests := []struct {
+		name   string
+		modify func(sso *SynapseSSO)
+		ok     bool
+	}{
+		{"valid", func(sso *SynapseSSO) {}, true},
+		{"duplicate ID", func(sso *SynapseSSO) {
+			sso.OIDCProviders = append(sso.OIDCProviders, sso.OIDCProviders[0])
+		}, false},
+		{"bad ID", func(sso *SynapseSSO) { sso.OIDCProviders[0].ID = "key cloak" }, false},
+		{"http issuer", func(sso *SynapseSSO) {
+			sso.OIDCProviders[0].Issuer = "http://keycloak.example.com/realms/example"
+		}, false},
+		{"issuer with query", func(sso *SynapseSSO) { sso.OIDCProviders[0].Issuer += "?x=1" }, false},
+		{"issuer with fragment", func(sso *SynapseSSO) { sso.OIDCProviders[0].Issuer += "#x" }, false},
+		{"no client ID", func(sso *SynapseSSO) { sso.OIDCProviders[0].ClientID = "" }, false},
+		{"scopes without openid", func(sso *SynapseSSO) {
+			sso.OIDCProviders[0].Scopes = []string{"profile"}
+		}, false},
+		{"scopes with openid", func(sso *SynapseSSO) {
+			sso.OIDCProviders[0].Scopes = []string{"openid", "profile"}
+		}, true},
+	}
+	for _, tt := range tests {
+		sso := &SynapseSSO{OIDCProviders: []OIDCProvider{valid}}
+		tt.modify(sso)
+		r := &Synapse{
+			ObjectMeta: metav1.ObjectMeta{Name: "test"},
+			Spec: SynapseSpec{
+				ServerName: "example.com",
+				SSO:        sso,
+			},
+		}
+		if err := r.ValidateCreate(); (err == nil) != tt.ok {
+			t.Errorf("%s: webhook: expect ok %t, got error %v", tt.name, tt.ok, err)
+		}
+
+		var providers []synapseconf.OIDCProviderConfig
+		for _, p := range sso.OIDCProviders {
+			providers = append(providers, p.SynapseConfig())
+		}
+		if err := synapseconf.ValidateOIDCProviders(providers); (err == nil) != tt.ok {
+			t.Errorf("%s: synapseconf: expect ok %t, got error %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestValidateCreateWorkerReplicas(t *testing.T) {
+	two := int32(2)
+	for _, typ := range []SynapseWorkerType{
+		WorkerGeneric,
+		WorkerFederationSender,
+		WorkerMedia,
+		WorkerPusher,
+		WorkerAppservice,
+	} {
+		r := &Synapse{
+			ObjectMeta: metav1.ObjectMeta{Name: "test"},
+			Spec: SynapseSpec{
+				ServerName: "example.com",
+				Redis:      &SynapseRedis{Managed: true},
+				Workers:    []SynapseWorker{{Type: typ, Replicas: &two}},
+			},
+		}
+		if err := r.ValidateCreate(); (err == nil) == typ.Singleton() {
+			t.Errorf("two %s workers: expect error %t, got %v", typ, typ.Singleton(), err)
+		}
+	}
+}
+
+func TestValidateCreateWorkersNeedRedis(t *testing.T) {
+	r := &Synapse{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: SynapseSpec{
+			ServerName: "example.com",
+			Workers:    []SynapseWorker{{Type: WorkerGeneric}},
+		},
+	}
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("workers without Redis: expect error, got nil")
+	}
+	r.Spec.Redis = &SynapseRedis{}
+	if err := r.ValidateCreate(); err == nil {
+		t.Error("workers with empty Redis: expect error, got nil")
+	}
+	r.Spec.Redis.External = &ExternalRedis{Host: "redis.example.com"}
+	if err := r.ValidateCreate(); err != nil {
+		t.Errorf("workers with external Redis: unexpected error: %v", err)
+	}
+}
@@ -21,16 +21,386 @@ limitations under the License.
 package v1alpha1
 
 import (
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseStatus) DeepCopyInto(out *DatabaseStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseStatus.
+func (in *DatabaseStatus) DeepCopy() *DatabaseStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalRedis) DeepCopyInto(out *ExternalRedis) {
+	*out = *in
+	if in.PasswordSecretKeyRef != nil {
+		in, out := &in.PasswordSecretKeyRef, &out.PasswordSecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalRedis.
+func (in *ExternalRedis) DeepCopy() *ExternalRedis {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalRedis)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalTurn) DeepCopyInto(out *ExternalTurn) {
+	*out = *in
+	if in.URIs != nil {
+		in, out := &in.URIs, &out.URIs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SharedSecretKeyRef != nil {
+		in, out := &in.SharedSecretKeyRef, &out.SharedSecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalTurn.
+func (in *ExternalTurn) DeepCopy() *ExternalTurn {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalTurn)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExtraConfigSource) DeepCopyInto(out *ExtraConfigSource) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExtraConfigSource.
+func (in *ExtraConfigSource) DeepCopy() *ExtraConfigSource {
+	if in == nil {
+		return nil
+	}
+	out := new(ExtraConfigSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedCoturn) DeepCopyInto(out *ManagedCoturn) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedCoturn.
+func (in *ManagedCoturn) DeepCopy() *ManagedCoturn {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedCoturn)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedPostgres) DeepCopyInto(out *ManagedPostgres) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedPostgres.
+func (in *ManagedPostgres) DeepCopy() *ManagedPostgres {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedPostgres)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedRedis) DeepCopyInto(out *ManagedRedis) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedRedis.
+func (in *ManagedRedis) DeepCopy() *ManagedRedis {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedRedis)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MediaRetention) DeepCopyInto(out *MediaRetention) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MediaRetention.
+func (in *MediaRetention) DeepCopy() *MediaRetention {
+	if in == nil {
+		return nil
+	}
+	out := new(MediaRetention)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MediaS3) DeepCopyInto(out *MediaS3) {
+	*out = *in
+	if in.AccessKeyIDSecretKeyRef != nil {
+		in, out := &in.AccessKeyIDSecretKeyRef, &out.AccessKeyIDSecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretAccessKeySecretKeyRef != nil {
+		in, out := &in.SecretAccessKeySecretKeyRef, &out.SecretAccessKeySecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.StoreLocal != nil {
+		in, out := &in.StoreLocal, &out.StoreLocal
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MediaS3.
+func (in *MediaS3) DeepCopy() *MediaS3 {
+	if in == nil {
+		return nil
+	}
+	out := new(MediaS3)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCProvider) DeepCopyInto(out *OIDCProvider) {
+	*out = *in
+	if in.ClientSecretSecretKeyRef != nil {
+		in, out := &in.ClientSecretSecretKeyRef, &out.ClientSecretSecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Scopes != nil {
+		in, out := &in.Scopes, &out.Scopes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.UserMapping != nil {
+		in, out := &in.UserMapping, &out.UserMapping
+		*out = new(OIDCUserMapping)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCProvider.
+func (in *OIDCProvider) DeepCopy() *OIDCProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCUserMapping) DeepCopyInto(out *OIDCUserMapping) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCUserMapping.
+func (in *OIDCUserMapping) DeepCopy() *OIDCUserMapping {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCUserMapping)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresDatabase) DeepCopyInto(out *PostgresDatabase) {
+	*out = *in
+	in.PasswordSecretKeyRef.DeepCopyInto(&out.PasswordSecretKeyRef)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresDatabase.
+func (in *PostgresDatabase) DeepCopy() *PostgresDatabase {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresDatabase)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistrationRecaptcha) DeepCopyInto(out *RegistrationRecaptcha) {
+	*out = *in
+	if in.PublicKeySecretKeyRef != nil {
+		in, out := &in.PublicKeySecretKeyRef, &out.PublicKeySecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PrivateKeySecretKeyRef != nil {
+		in, out := &in.PrivateKeySecretKeyRef, &out.PrivateKeySecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistrationRecaptcha.
+func (in *RegistrationRecaptcha) DeepCopy() *RegistrationRecaptcha {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistrationRecaptcha)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretRotation) DeepCopyInto(out *SecretRotation) {
+	*out = *in
+	if in.RegistrationSharedSecret != nil {
+		in, out := &in.RegistrationSharedSecret, &out.RegistrationSharedSecret
+		*out = (*in).DeepCopy()
+	}
+	if in.MacaroonSecretKey != nil {
+		in, out := &in.MacaroonSecretKey, &out.MacaroonSecretKey
+		*out = (*in).DeepCopy()
+	}
+	if in.FormSecret != nil {
+		in, out := &in.FormSecret, &out.FormSecret
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretRotation.
+func (in *SecretRotation) DeepCopy() *SecretRotation {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretRotation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretRotationStatus) DeepCopyInto(out *SecretRotationStatus) {
+	*out = *in
+	in.LastRotation.DeepCopyInto(&out.LastRotation)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretRotationStatus.
+func (in *SecretRotationStatus) DeepCopy() *SecretRotationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretRotationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SigningKeyStatus) DeepCopyInto(out *SigningKeyStatus) {
+	*out = *in
+	if in.LastRotation != nil {
+		in, out := &in.LastRotation, &out.LastRotation
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SigningKeyStatus.
+func (in *SigningKeyStatus) DeepCopy() *SigningKeyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SigningKeyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageStatus) DeepCopyInto(out *StorageStatus) {
+	*out = *in
+	if in.Capacity != nil {
+		in, out := &in.Capacity, &out.Capacity
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageStatus.
+func (in *StorageStatus) DeepCopy() *StorageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Synapse) DeepCopyInto(out *Synapse) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Synapse.
@@ -51,6 +421,110 @@ func (in *Synapse) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseDatabase) DeepCopyInto(out *SynapseDatabase) {
+	*out = *in
+	if in.Postgres != nil {
+		in, out := &in.Postgres, &out.Postgres
+		*out = new(PostgresDatabase)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ManagedPostgres != nil {
+		in, out := &in.ManagedPostgres, &out.ManagedPostgres
+		*out = new(ManagedPostgres)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseDatabase.
+func (in *SynapseDatabase) DeepCopy() *SynapseDatabase {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseDatabase)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseDelegation) DeepCopyInto(out *SynapseDelegation) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseDelegation.
+func (in *SynapseDelegation) DeepCopy() *SynapseDelegation {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseDelegation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseEmail) DeepCopyInto(out *SynapseEmail) {
+	*out = *in
+	if in.UserSecretKeyRef != nil {
+		in, out := &in.UserSecretKeyRef, &out.UserSecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PasswordSecretKeyRef != nil {
+		in, out := &in.PasswordSecretKeyRef, &out.PasswordSecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseEmail.
+func (in *SynapseEmail) DeepCopy() *SynapseEmail {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseEmail)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseExpose) DeepCopyInto(out *SynapseExpose) {
+	*out = *in
+	if in.ServiceAnnotations != nil {
+		in, out := &in.ServiceAnnotations, &out.ServiceAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Hosts != nil {
+		in, out := &in.Hosts, &out.Hosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IngressClassName != nil {
+		in, out := &in.IngressClassName, &out.IngressClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.IngressAnnotations != nil {
+		in, out := &in.IngressAnnotations, &out.IngressAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseExpose.
+func (in *SynapseExpose) DeepCopy() *SynapseExpose {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseExpose)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SynapseList) DeepCopyInto(out *SynapseList) {
 	*out = *in
@@ -83,9 +557,239 @@ func (in *SynapseList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseMedia) DeepCopyInto(out *SynapseMedia) {
+	*out = *in
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(MediaS3)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Retention != nil {
+		in, out := &in.Retention, &out.Retention
+		*out = new(MediaRetention)
+		**out = **in
+	}
+	if in.ThumbnailSizes != nil {
+		in, out := &in.ThumbnailSizes, &out.ThumbnailSizes
+		*out = make([]ThumbnailSize, len(*in))
+		copy(*out, *in)
+	}
+	if in.URLPreview != nil {
+		in, out := &in.URLPreview, &out.URLPreview
+		*out = new(URLPreview)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseMedia.
+func (in *SynapseMedia) DeepCopy() *SynapseMedia {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseMedia)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseRedis) DeepCopyInto(out *SynapseRedis) {
+	*out = *in
+	if in.External != nil {
+		in, out := &in.External, &out.External
+		*out = new(ExternalRedis)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ManagedRedis != nil {
+		in, out := &in.ManagedRedis, &out.ManagedRedis
+		*out = new(ManagedRedis)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseRedis.
+func (in *SynapseRedis) DeepCopy() *SynapseRedis {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseRedis)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseRegistration) DeepCopyInto(out *SynapseRegistration) {
+	*out = *in
+	if in.RequiredThreepids != nil {
+		in, out := &in.RequiredThreepids, &out.RequiredThreepids
+		*out = make([]ThreepidMedium, len(*in))
+		copy(*out, *in)
+	}
+	if in.AutoJoinRooms != nil {
+		in, out := &in.AutoJoinRooms, &out.AutoJoinRooms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Recaptcha != nil {
+		in, out := &in.Recaptcha, &out.Recaptcha
+		*out = new(RegistrationRecaptcha)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseRegistration.
+func (in *SynapseRegistration) DeepCopy() *SynapseRegistration {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseRegistration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseSSO) DeepCopyInto(out *SynapseSSO) {
+	*out = *in
+	if in.OIDCProviders != nil {
+		in, out := &in.OIDCProviders, &out.OIDCProviders
+		*out = make([]OIDCProvider, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseSSO.
+func (in *SynapseSSO) DeepCopy() *SynapseSSO {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseSSO)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseSecrets) DeepCopyInto(out *SynapseSecrets) {
+	*out = *in
+	if in.Rotate != nil {
+		in, out := &in.Rotate, &out.Rotate
+		*out = new(SecretRotation)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseSecrets.
+func (in *SynapseSecrets) DeepCopy() *SynapseSecrets {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseSecrets)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseSigningKey) DeepCopyInto(out *SynapseSigningKey) {
+	*out = *in
+	if in.Rotate != nil {
+		in, out := &in.Rotate, &out.Rotate
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseSigningKey.
+func (in *SynapseSigningKey) DeepCopy() *SynapseSigningKey {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseSigningKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SynapseSpec) DeepCopyInto(out *SynapseSpec) {
 	*out = *in
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(SynapseStorage)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Database != nil {
+		in, out := &in.Database, &out.Database
+		*out = new(SynapseDatabase)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Expose != nil {
+		in, out := &in.Expose, &out.Expose
+		*out = new(SynapseExpose)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Delegation != nil {
+		in, out := &in.Delegation, &out.Delegation
+		*out = new(SynapseDelegation)
+		**out = **in
+	}
+	if in.Workers != nil {
+		in, out := &in.Workers, &out.Workers
+		*out = make([]SynapseWorker, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Redis != nil {
+		in, out := &in.Redis, &out.Redis
+		*out = new(SynapseRedis)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ExtraConfig != nil {
+		in, out := &in.ExtraConfig, &out.ExtraConfig
+		*out = make([]ExtraConfigSource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ConfigTemplate != nil {
+		in, out := &in.ConfigTemplate, &out.ConfigTemplate
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SigningKey != nil {
+		in, out := &in.SigningKey, &out.SigningKey
+		*out = new(SynapseSigningKey)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = new(SynapseSecrets)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Email != nil {
+		in, out := &in.Email, &out.Email
+		*out = new(SynapseEmail)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Turn != nil {
+		in, out := &in.Turn, &out.Turn
+		*out = new(SynapseTurn)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Media != nil {
+		in, out := &in.Media, &out.Media
+		*out = new(SynapseMedia)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Registration != nil {
+		in, out := &in.Registration, &out.Registration
+		*out = new(SynapseRegistration)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SSO != nil {
+		in, out := &in.SSO, &out.SSO
+		*out = new(SynapseSSO)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseSpec.
@@ -101,6 +805,40 @@ func (in *SynapseSpec) DeepCopy() *SynapseSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SynapseStatus) DeepCopyInto(out *SynapseStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TemplateSecrets != nil {
+		in, out := &in.TemplateSecrets, &out.TemplateSecrets
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(StorageStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Database != nil {
+		in, out := &in.Database, &out.Database
+		*out = new(DatabaseStatus)
+		**out = **in
+	}
+	if in.SigningKey != nil {
+		in, out := &in.SigningKey, &out.SigningKey
+		*out = new(SigningKeyStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretRotations != nil {
+		in, out := &in.SecretRotations, &out.SecretRotations
+		*out = make([]SecretRotationStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseStatus.
@@ -112,3 +850,123 @@ func (in *SynapseStatus) DeepCopy() *SynapseStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseStorage) DeepCopyInto(out *SynapseStorage) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.AccessModes != nil {
+		in, out := &in.AccessModes, &out.AccessModes
+		*out = make([]v1.PersistentVolumeAccessMode, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseStorage.
+func (in *SynapseStorage) DeepCopy() *SynapseStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseTurn) DeepCopyInto(out *SynapseTurn) {
+	*out = *in
+	if in.External != nil {
+		in, out := &in.External, &out.External
+		*out = new(ExternalTurn)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ManagedCoturn != nil {
+		in, out := &in.ManagedCoturn, &out.ManagedCoturn
+		*out = new(ManagedCoturn)
+		**out = **in
+	}
+	if in.AllowGuests != nil {
+		in, out := &in.AllowGuests, &out.AllowGuests
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseTurn.
+func (in *SynapseTurn) DeepCopy() *SynapseTurn {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseTurn)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SynapseWorker) DeepCopyInto(out *SynapseWorker) {
+	*out = *in
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SynapseWorker.
+func (in *SynapseWorker) DeepCopy() *SynapseWorker {
+	if in == nil {
+		return nil
+	}
+	out := new(SynapseWorker)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ThumbnailSize) DeepCopyInto(out *ThumbnailSize) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ThumbnailSize.
+func (in *ThumbnailSize) DeepCopy() *ThumbnailSize {
+	if in == nil {
+		return nil
+	}
+	out := new(ThumbnailSize)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *URLPreview) DeepCopyInto(out *URLPreview) {
+	*out = *in
+	if in.IPRangeBlacklist != nil {
+		in, out := &in.IPRangeBlacklist, &out.IPRangeBlacklist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IPRangeWhitelist != nil {
+		in, out := &in.IPRangeWhitelist, &out.IPRangeWhitelist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new URLPreview.
+func (in *URLPreview) DeepCopy() *URLPreview {
+	if in == nil {
+		return nil
+	}
+	out := new(URLPreview)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	v1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+)
+
+const synapseHTTPPort = 8008
+
+// An ingressRoute sends requests for paths starting with Path (or equal to
+// it, if Exact is set) to the named Service.
+type ingressRoute struct {
+	Path        string
+	Exact       bool
+	ServiceName string
+	ServicePort intstr.IntOrString
+}
+
+func synapseService(cr *matrixv1alpha1.Synapse) *v1.Service {
+	serviceType := v1.ServiceTypeClusterIP
+	var annotations map[string]string
+	if ex := cr.Spec.Expose; ex != nil {
+		if ex.ServiceType != "" {
+			serviceType = ex.ServiceType
+		}
+		annotations = ex.ServiceAnnotations
+	}
+
+	return &v1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cr.Name,
+			Namespace:   cr.Namespace,
+			Labels:      synapseLabels(cr.Name),
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type:     serviceType,
+			Selector: synapseLabels(cr.Name),
+			Ports: []v1.ServicePort{{
+				Name:       "http",
+				Protocol:   v1.ProtocolTCP,
+				Port:       synapseHTTPPort,
+				TargetPort: intstr.FromString("http"),
+			}},
+		},
+	}
+}
+
+// WantsIngress reports whether the CR asks for an Ingress.
+func wantsIngress(cr *matrixv1alpha1.Synapse) bool {
+	return cr.Spec.Expose != nil && len(cr.Spec.Expose.Hosts) > 0
+}
+
+// SynapseIngressRoutes returns the routes the Ingress serves on each of the
+// exposed hosts. Endpoints handled by workers are routed to them, the rest
+// goes to the main process.
+func synapseIngressRoutes(cr *matrixv1alpha1.Synapse) []ingressRoute {
+	port := intstr.FromString("http")
+	return append(workerIngressRoutes(cr),
+		ingressRoute{Path: "/_matrix", ServiceName: cr.Name, ServicePort: port},
+		ingressRoute{Path: "/_synapse/client", ServiceName: cr.Name, ServicePort: port},
+	)
+}
+
+func synapseIngress(cr *matrixv1alpha1.Synapse) *networkingv1beta1.Ingress {
+	ex := cr.Spec.Expose
+
+	var paths []networkingv1beta1.HTTPIngressPath
+	for _, route := range synapseIngressRoutes(cr) {
+		pathType := networkingv1beta1.PathTypePrefix
+		if route.Exact {
+			pathType = networkingv1beta1.PathTypeExact
+		}
+		paths = append(paths, networkingv1beta1.HTTPIngressPath{
+			Path:     route.Path,
+			PathType: &pathType,
+			Backend: networkingv1beta1.IngressBackend{
+				ServiceName: route.ServiceName,
+				ServicePort: route.ServicePort,
+			},
+		})
+	}
+
+	var rules []networkingv1beta1.IngressRule
+	for _, host := range ex.Hosts {
+		rules = append(rules, networkingv1beta1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1beta1.IngressRuleValue{
+				HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+					Paths: paths,
+				},
+			},
+		})
+	}
+
+	var tls []networkingv1beta1.IngressTLS
+	if ex.TLSSecretName != "" {
+		tls = []networkingv1beta1.IngressTLS{{
+			Hosts:      ex.Hosts,
+			SecretName: ex.TLSSecretName,
+		}}
+	}
+
+	return &networkingv1beta1.Ingress{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1beta1.SchemeGroupVersion.String(),
+			Kind:       "Ingress",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cr.Name,
+			Namespace:   cr.Namespace,
+			Labels:      synapseLabels(cr.Name),
+			Annotations: ex.IngressAnnotations,
+		},
+		Spec: networkingv1beta1.IngressSpec{
+			IngressClassName: ex.IngressClassName,
+			TLS:              tls,
+			Rules:            rules,
+		},
+	}
+}
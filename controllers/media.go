@@ -0,0 +1,183 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+// S3ModuleCheckImageAnnotationKey records on the module check Job the image
+// it inspects.
+const s3ModuleCheckImageAnnotationKey = "matrix.slrz.net/image"
+
+// StoresMediaInS3 reports whether the CR configures an S3 media storage
+// provider.
+func storesMediaInS3(cr *matrixv1alpha1.Synapse) bool {
+	return cr.Spec.Media != nil && cr.Spec.Media.S3 != nil
+}
+
+// KeepsLocalMedia reports whether the local media store lives on the data
+// volume. Otherwise it's an emptyDir serving as a cache in front of the
+// object store.
+func keepsLocalMedia(cr *matrixv1alpha1.Synapse) bool {
+	if !storesMediaInS3(cr) {
+		return true
+	}
+	sl := cr.Spec.Media.S3.StoreLocal
+	return sl == nil || *sl
+}
+
+// MediaConfig returns the media repository settings from the CR, or nil if
+// there are none.
+func mediaConfig(cr *matrixv1alpha1.Synapse) *synapseconf.MediaConfig {
+	md := cr.Spec.Media
+	if md == nil || (md.MaxUploadSize == "" && md.Retention == nil &&
+		len(md.ThumbnailSizes) == 0 && md.URLPreview == nil) {
+		return nil
+	}
+
+	c := &synapseconf.MediaConfig{
+		MaxUploadSize: md.MaxUploadSize,
+	}
+	if rt := md.Retention; rt != nil {
+		c.LocalMediaLifetime = rt.LocalMediaLifetime
+		c.RemoteMediaLifetime = rt.RemoteMediaLifetime
+	}
+	for _, ts := range md.ThumbnailSizes {
+		c.ThumbnailSizes = append(c.ThumbnailSizes, synapseconf.ThumbnailSize{
+			Width:  int(ts.Width),
+			Height: int(ts.Height),
+			Method: ts.Method,
+		})
+	}
+	if up := md.URLPreview; up != nil {
+		c.URLPreviewEnabled = true
+		c.URLPreviewIPRangeBlacklist = up.IPRangeBlacklist
+		c.URLPreviewIPRangeWhitelist = up.IPRangeWhitelist
+		c.MaxSpiderSize = up.MaxSpiderSize
+	}
+	return c
+}
+
+// ValidateMedia checks the media repository settings of the CR.
+func validateMedia(cr *matrixv1alpha1.Synapse) error {
+	c := mediaConfig(cr)
+	if c == nil {
+		return nil
+	}
+	if err := synapseconf.ValidateMediaConfig(c); err != nil {
+		return invalidSpecf("media: %v", err)
+	}
+	return nil
+}
+
+// S3ModuleCheckName returns the name of the Job checking the Synapse image
+// for synapse-s3-storage-provider.
+func s3ModuleCheckName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-s3-module-check"
+}
+
+// S3ModuleCheckJob returns a Job that succeeds if the Synapse image can
+// import synapse-s3-storage-provider.
+func s3ModuleCheckJob(cr *matrixv1alpha1.Synapse) *batchv1.Job {
+	image := matrixv1alpha1.DefaultImage
+	if cr.Spec.Image != "" {
+		image = cr.Spec.Image
+	}
+	backoffLimit := int32(0)
+	deadline := int64(600)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s3ModuleCheckName(cr),
+			Namespace: cr.Namespace,
+			Labels:    synapseLabels(cr.Name),
+			Annotations: map[string]string{
+				s3ModuleCheckImageAnnotationKey: image,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &deadline,
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					RestartPolicy: v1.RestartPolicyNever,
+					Containers: []v1.Container{{
+						Image:   image,
+						Name:    "check",
+						Command: []string{"python", "-c", "import s3_storage_provider"},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// SetMediaStorageReadyCondition records the outcome of the module check
+// job. It reports whether the condition changed to ModuleMissing.
+func setMediaStorageReadyCondition(cr *matrixv1alpha1.Synapse, job *batchv1.Job) bool {
+	image := job.Annotations[s3ModuleCheckImageAnnotationKey]
+	switch {
+	case job.Status.Succeeded > 0:
+		setCondition(cr, matrixv1alpha1.ConditionMediaStorageReady,
+			metav1.ConditionTrue, reasonModuleFound, "")
+	case job.Status.Failed > 0:
+		c := matrixv1alpha1.FindCondition(cr.Status.Conditions, matrixv1alpha1.ConditionMediaStorageReady)
+		changed := c == nil || c.Reason != reasonModuleMissing
+		setCondition(cr, matrixv1alpha1.ConditionMediaStorageReady,
+			metav1.ConditionFalse, reasonModuleMissing,
+			fmt.Sprintf("image %s can't import s3_storage_provider; install synapse-s3-storage-provider", image))
+		return changed
+	default:
+		setCondition(cr, matrixv1alpha1.ConditionMediaStorageReady,
+			metav1.ConditionUnknown, reasonCheckingModule,
+			fmt.Sprintf("checking image %s for s3_storage_provider", image))
+	}
+	return false
+}
+
+// MediaVolumes returns the volume replacing the local media store on the
+// data volume, if any.
+func mediaVolumes(cr *matrixv1alpha1.Synapse) []v1.Volume {
+	if keepsLocalMedia(cr) {
+		return nil
+	}
+	return []v1.Volume{{
+		Name: "media",
+		VolumeSource: v1.VolumeSource{
+			EmptyDir: &v1.EmptyDirVolumeSource{},
+		},
+	}}
+}
+
+// MediaVolumeMounts mounts the volumes returned by mediaVolumes.
+func mediaVolumeMounts(cr *matrixv1alpha1.Synapse) []v1.VolumeMount {
+	if keepsLocalMedia(cr) {
+		return nil
+	}
+	return []v1.VolumeMount{{
+		Name:      "media",
+		MountPath: "/data/media",
+	}}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+const (
+	postgresUser     = "synapse"
+	postgresDatabase = "synapse"
+	postgresPort     = 5432
+)
+
+// ManagesPostgres reports whether the CR asks for an operator-managed
+// database.
+func managesPostgres(cr *matrixv1alpha1.Synapse) bool {
+	return cr.Spec.Database != nil && cr.Spec.Database.Managed
+}
+
+// ManagedPostgresName returns the name shared by the Secret, Service and
+// StatefulSet making up the managed database.
+func managedPostgresName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-postgres"
+}
+
+func postgresLabels(name string) map[string]string {
+	return map[string]string{"app": "synapse-postgres", "synapse_cr": name}
+}
+
+func synapsePostgresSecret(cr *matrixv1alpha1.Synapse) (*v1.Secret, error) {
+	password, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedPostgresName(cr),
+			Namespace: cr.Namespace,
+			Labels:    postgresLabels(cr.Name),
+		},
+		Data: map[string][]byte{
+			"password": []byte(password),
+		},
+		Type: "Opaque",
+	}, nil
+}
+
+func synapsePostgresService(cr *matrixv1alpha1.Synapse) *v1.Service {
+	return &v1.Service{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedPostgresName(cr),
+			Namespace: cr.Namespace,
+			Labels:    postgresLabels(cr.Name),
+		},
+		Spec: v1.ServiceSpec{
+			// Headless, as it's also the StatefulSet's governing
+			// service.
+			ClusterIP: v1.ClusterIPNone,
+			Selector:  postgresLabels(cr.Name),
+			Ports: []v1.ServicePort{{
+				Name:       "postgres",
+				Port:       postgresPort,
+				TargetPort: intstr.FromString("postgres"),
+			}},
+		},
+	}
+}
+
+func synapsePostgresStatefulSet(cr *matrixv1alpha1.Synapse) *appsv1.StatefulSet {
+	ls := postgresLabels(cr.Name)
+	replicas := int32(1)
+	image := matrixv1alpha1.DefaultPostgresImage
+	size := defaultStorageSize
+	var storageClassName *string
+	if mp := cr.Spec.Database.ManagedPostgres; mp != nil {
+		if mp.Image != "" {
+			image = mp.Image
+		}
+		if mp.Size != nil {
+			size = *mp.Size
+		}
+		storageClassName = mp.StorageClassName
+	}
+
+	return &appsv1.StatefulSet{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "StatefulSet",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedPostgresName(cr),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: managedPostgresName(cr),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ls,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Image: image,
+						Name:  "postgres",
+						Env: []v1.EnvVar{
+							{Name: "POSTGRES_USER", Value: postgresUser},
+							{Name: "POSTGRES_DB", Value: postgresDatabase},
+							{
+								Name: "POSTGRES_PASSWORD",
+								ValueFrom: &v1.EnvVarSource{
+									SecretKeyRef: managedPostgresSecretKeyRef(cr),
+								},
+							},
+							// Synapse refuses to run on databases
+							// with a collation other than C.
+							{
+								Name:  "POSTGRES_INITDB_ARGS",
+								Value: "--encoding=UTF8 --lc-collate=C --lc-ctype=C",
+							},
+							// The volume root may contain lost+found
+							// which initdb doesn't like.
+							{
+								Name:  "PGDATA",
+								Value: "/var/lib/postgresql/data/pgdata",
+							},
+						},
+						Ports: []v1.ContainerPort{{
+							ContainerPort: postgresPort,
+							Name:          "postgres",
+						}},
+						ReadinessProbe: &v1.Probe{
+							Handler: v1.Handler{
+								Exec: &v1.ExecAction{
+									Command: []string{
+										"pg_isready",
+										"-U", postgresUser,
+										"-d", postgresDatabase,
+									},
+								},
+							},
+							PeriodSeconds: 10,
+						},
+						VolumeMounts: []v1.VolumeMount{{
+							Name:      "data",
+							MountPath: "/var/lib/postgresql/data",
+						}},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []v1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "data",
+					Labels: ls,
+				},
+				Spec: v1.PersistentVolumeClaimSpec{
+					AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					StorageClassName: storageClassName,
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{
+							v1.ResourceStorage: size,
+						},
+					},
+				},
+			}},
+		},
+	}
+}
+
+// ManagedPostgresSecretKeyRef selects the password of the managed database.
+func managedPostgresSecretKeyRef(cr *matrixv1alpha1.Synapse) *v1.SecretKeySelector {
+	return &v1.SecretKeySelector{
+		LocalObjectReference: v1.LocalObjectReference{
+			Name: managedPostgresName(cr),
+		},
+		Key: "password",
+	}
+}
+
+// ManagedPostgresConfig returns the connection parameters for the managed
+// database, except for the password.
+func managedPostgresConfig(cr *matrixv1alpha1.Synapse) *synapseconf.PostgresConfig {
+	return &synapseconf.PostgresConfig{
+		User:     postgresUser,
+		Database: postgresDatabase,
+		Host:     managedPostgresName(cr),
+		Port:     strconv.Itoa(postgresPort),
+	}
+}
+
+// ManagedPostgresReady reports whether the managed database accepts
+// connections.
+func managedPostgresReady(sts *appsv1.StatefulSet) bool {
+	return sts.Status.ReadyReplicas > 0
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+const redisPort = 6379
+
+// ManagesRedis reports whether the CR asks for an operator-managed Redis
+// server.
+func managesRedis(cr *matrixv1alpha1.Synapse) bool {
+	return cr.Spec.Redis != nil && cr.Spec.Redis.Managed
+}
+
+// ManagedRedisName returns the name shared by the Secret, Service and
+// Deployment making up the managed Redis server.
+func managedRedisName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-redis"
+}
+
+func redisLabels(name string) map[string]string {
+	return map[string]string{"app": "synapse-redis", "synapse_cr": name}
+}
+
+func synapseRedisSecret(cr *matrixv1alpha1.Synapse) (*v1.Secret, error) {
+	password, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedRedisName(cr),
+			Namespace: cr.Namespace,
+			Labels:    redisLabels(cr.Name),
+		},
+		Data: map[string][]byte{
+			"password": []byte(password),
+		},
+		Type: "Opaque",
+	}, nil
+}
+
+func synapseRedisService(cr *matrixv1alpha1.Synapse) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedRedisName(cr),
+			Namespace: cr.Namespace,
+			Labels:    redisLabels(cr.Name),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeClusterIP,
+			Selector: redisLabels(cr.Name),
+			Ports: []v1.ServicePort{{
+				Name:       "redis",
+				Protocol:   v1.ProtocolTCP,
+				Port:       redisPort,
+				TargetPort: intstr.FromString("redis"),
+			}},
+		},
+	}
+}
+
+// SynapseRedisDeployment returns the Deployment running the managed Redis
+// server. Synapse only uses Redis for pub/sub, so there's nothing worth
+// persisting.
+func synapseRedisDeployment(cr *matrixv1alpha1.Synapse) *appsv1.Deployment {
+	ls := redisLabels(cr.Name)
+	replicas := int32(1)
+	image := matrixv1alpha1.DefaultRedisImage
+	if mr := cr.Spec.Redis.ManagedRedis; mr != nil && mr.Image != "" {
+		image = mr.Image
+	}
+
+	return &appsv1.Deployment{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedRedisName(cr),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ls,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Image: image,
+						Name:  "redis",
+						Args: []string{
+							"--requirepass", "$(REDIS_PASSWORD)",
+							"--save", "",
+							"--appendonly", "no",
+						},
+						Env: []v1.EnvVar{{
+							Name: "REDIS_PASSWORD",
+							ValueFrom: &v1.EnvVarSource{
+								SecretKeyRef: managedRedisSecretKeyRef(cr),
+							},
+						}},
+						Ports: []v1.ContainerPort{{
+							ContainerPort: redisPort,
+							Name:          "redis",
+						}},
+						ReadinessProbe: &v1.Probe{
+							Handler: v1.Handler{
+								TCPSocket: &v1.TCPSocketAction{
+									Port: intstr.FromString("redis"),
+								},
+							},
+							PeriodSeconds: 10,
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// ManagedRedisSecretKeyRef selects the password of the managed Redis server.
+func managedRedisSecretKeyRef(cr *matrixv1alpha1.Synapse) *v1.SecretKeySelector {
+	return &v1.SecretKeySelector{
+		LocalObjectReference: v1.LocalObjectReference{
+			Name: managedRedisName(cr),
+		},
+		Key: "password",
+	}
+}
+
+// ManagedRedisConfig returns the connection parameters for the managed
+// Redis server, except for the password.
+func managedRedisConfig(cr *matrixv1alpha1.Synapse) *synapseconf.RedisConfig {
+	return &synapseconf.RedisConfig{
+		Host: managedRedisName(cr),
+		Port: strconv.Itoa(redisPort),
+	}
+}
@@ -0,0 +1,670 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+// ResolvedRefs holds configuration values the Synapse CR refers to
+// indirectly, e.g. passwords stored in user-managed Secrets.
+type resolvedRefs struct {
+	postgres *synapseconf.PostgresConfig
+	redis    *synapseconf.RedisConfig
+	email    *synapseconf.EmailConfig
+	turn     *synapseconf.TurnConfig
+	// S3 media storage provider, if any
+	s3Storage    *synapseconf.S3StorageConfig
+	registration *synapseconf.RegistrationConfig
+	oidc         []synapseconf.OIDCProviderConfig
+	// contents of the ExtraConfig sources, in order
+	extraConfig [][]byte
+	// user-supplied homeserver.yaml template, if any
+	configTemplate string
+	// verify keys of retired signing keys, from the Synapse Secret
+	oldSigningKeys map[string]synapseconf.OldSigningKey
+}
+
+// An invalidSpecError reports a problem with the Synapse CR that won't go
+// away by retrying. It is resolved by fixing the spec.
+type invalidSpecError struct {
+	msg string
+}
+
+func (e *invalidSpecError) Error() string {
+	return "invalid spec: " + e.msg
+}
+
+func invalidSpecf(format string, a ...interface{}) error {
+	return &invalidSpecError{msg: fmt.Sprintf(format, a...)}
+}
+
+// IsInvalidSpec reports whether err was caused by an invalid Synapse spec.
+func isInvalidSpec(err error) bool {
+	var e *invalidSpecError
+	return errors.As(err, &e)
+}
+
+// ResolveRefs looks up all values referenced by the CR.
+func (r *SynapseReconciler) resolveRefs(ctx context.Context, cr *matrixv1alpha1.Synapse) (*resolvedRefs, error) {
+	refs := &resolvedRefs{}
+
+	if db := cr.Spec.Database; db != nil {
+		if db.Managed && db.Postgres != nil {
+			return nil, invalidSpecf("database.managed and database.postgres are mutually exclusive")
+		}
+		if db.Postgres != nil {
+			pg, err := r.resolvePostgresConfig(ctx, cr, db.Postgres)
+			if err != nil {
+				return nil, err
+			}
+			refs.postgres = pg
+		}
+		if db.Managed {
+			pg := managedPostgresConfig(cr)
+			password, err := r.secretKeyValue(ctx, cr.Namespace, managedPostgresSecretKeyRef(cr))
+			if err != nil {
+				return nil, fmt.Errorf("managed database password: %w", err)
+			}
+			pg.Password = password
+			refs.postgres = pg
+		}
+	}
+
+	if rd := cr.Spec.Redis; rd != nil {
+		if rd.Managed && rd.External != nil {
+			return nil, invalidSpecf("redis.managed and redis.external are mutually exclusive")
+		}
+		if rd.External != nil {
+			c, err := r.resolveRedisConfig(ctx, cr, rd.External)
+			if err != nil {
+				return nil, err
+			}
+			refs.redis = c
+		}
+		if rd.Managed {
+			c := managedRedisConfig(cr)
+			password, err := r.secretKeyValue(ctx, cr.Namespace, managedRedisSecretKeyRef(cr))
+			if err != nil {
+				return nil, fmt.Errorf("managed redis password: %w", err)
+			}
+			c.Password = password
+			refs.redis = c
+		}
+	}
+
+	if em := cr.Spec.Email; em != nil {
+		c, err := r.resolveEmailConfig(ctx, cr, em)
+		if err != nil {
+			return nil, err
+		}
+		refs.email = c
+	}
+
+	if tu := cr.Spec.Turn; tu != nil {
+		c, err := r.resolveTurnConfig(ctx, cr, tu)
+		if err != nil {
+			return nil, err
+		}
+		refs.turn = c
+	}
+
+	if reg := cr.Spec.Registration; reg != nil {
+		c, err := r.resolveRegistrationConfig(ctx, cr, reg)
+		if err != nil {
+			return nil, err
+		}
+		refs.registration = c
+	}
+
+	if sso := cr.Spec.SSO; sso != nil && len(sso.OIDCProviders) > 0 {
+		providers, err := r.resolveOIDCProviders(ctx, cr, sso.OIDCProviders)
+		if err != nil {
+			return nil, err
+		}
+		refs.oidc = providers
+	}
+
+	if md := cr.Spec.Media; md != nil && md.S3 != nil {
+		c, err := r.resolveS3StorageConfig(ctx, cr, md.S3)
+		if err != nil {
+			return nil, err
+		}
+		refs.s3Storage = c
+	}
+
+	for i, src := range cr.Spec.ExtraConfig {
+		p, err := r.resolveExtraConfig(ctx, cr, src)
+		if err != nil {
+			return nil, fmt.Errorf("extraConfig[%d]: %w", i, err)
+		}
+		if p != nil {
+			refs.extraConfig = append(refs.extraConfig, p)
+		}
+	}
+
+	if sel := cr.Spec.ConfigTemplate; sel != nil {
+		text, err := r.configMapKeyValue(ctx, cr.Namespace, sel)
+		if err != nil {
+			return nil, fmt.Errorf("configTemplate: %w", err)
+		}
+		// Report syntax errors as such, execution has to wait until
+		// we know the rest of the config.
+		if _, err := synapseconf.ParseHomeserverTemplate(text); err != nil {
+			return nil, invalidSpecf("configTemplate: %v", err)
+		}
+		refs.configTemplate = text
+	}
+
+	return refs, nil
+}
+
+// ResolveExtraConfig returns the contents of the key selected by src. It
+// returns nil if the key doesn't exist but is marked optional.
+func (r *SynapseReconciler) resolveExtraConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, src matrixv1alpha1.ExtraConfigSource) ([]byte, error) {
+	var (
+		value    string
+		optional *bool
+		err      error
+	)
+	switch {
+	case src.ConfigMapKeyRef != nil && src.SecretKeyRef != nil:
+		return nil, invalidSpecf("configMapKeyRef and secretKeyRef are mutually exclusive")
+	case src.ConfigMapKeyRef != nil:
+		optional = src.ConfigMapKeyRef.Optional
+		value, err = r.configMapKeyValue(ctx, cr.Namespace, src.ConfigMapKeyRef)
+	case src.SecretKeyRef != nil:
+		optional = src.SecretKeyRef.Optional
+		value, err = r.secretKeyValue(ctx, cr.Namespace, src.SecretKeyRef)
+	default:
+		return nil, invalidSpecf("need configMapKeyRef or secretKeyRef")
+	}
+	if err != nil {
+		if optional != nil && *optional && isMissingKey(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Catch malformed documents early, instead of failing to generate
+	// homeserver.yaml later on.
+	if _, err := synapseconf.MergeYAML(nil, []byte(value)); err != nil {
+		return nil, invalidSpecf("%v", err)
+	}
+	return []byte(value), nil
+}
+
+// ImportedSecretKeys lists the keys copied from spec.secrets.existingSecretName.
+var importedSecretKeys = append([]string{
+	signingKeySecretKey,
+	oldSigningKeysSecretKey,
+}, generatedSecretKeys...)
+
+// ImportedSecretData returns the values to seed the Synapse Secret with,
+// as found in the Secret named by spec.secrets.existingSecretName. It
+// returns nil if the CR doesn't name one.
+func (r *SynapseReconciler) importedSecretData(ctx context.Context, cr *matrixv1alpha1.Synapse) (map[string][]byte, error) {
+	sec := cr.Spec.Secrets
+	if sec == nil || sec.ExistingSecretName == "" {
+		return nil, nil
+	}
+	if sec.ExistingSecretName == cr.Name {
+		return nil, invalidSpecf("secrets.existingSecretName: %s is managed by the operator", cr.Name)
+	}
+
+	existing := &v1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      sec.ExistingSecretName,
+		Namespace: cr.Namespace,
+	}, existing)
+	if err != nil {
+		return nil, fmt.Errorf("secrets.existingSecretName: %w", err)
+	}
+
+	data := make(map[string][]byte)
+	for _, k := range importedSecretKeys {
+		if v := existing.Data[k]; len(v) > 0 {
+			data[k] = v
+		}
+	}
+	if p, ok := data[signingKeySecretKey]; ok {
+		if _, err := synapseconf.ParseSigningKeys(p); err != nil {
+			return nil, invalidSpecf("secrets.existingSecretName: %s: %v", signingKeySecretKey, err)
+		}
+	}
+	if p, ok := data[oldSigningKeysSecretKey]; ok {
+		if _, err := synapseconf.ParseOldSigningKeys(p); err != nil {
+			return nil, invalidSpecf("secrets.existingSecretName: %s: %v", oldSigningKeysSecretKey, err)
+		}
+	}
+	return data, nil
+}
+
+func (r *SynapseReconciler) resolveRedisConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, rd *matrixv1alpha1.ExternalRedis) (*synapseconf.RedisConfig, error) {
+	if rd.Host == "" {
+		return nil, invalidSpecf("redis.external.host must not be empty")
+	}
+	if rd.Port < 0 || rd.Port > 65535 {
+		return nil, invalidSpecf("redis.external.port: %d out of range", rd.Port)
+	}
+
+	c := &synapseconf.RedisConfig{
+		Host: rd.Host,
+	}
+	if rd.Port != 0 {
+		c.Port = strconv.Itoa(int(rd.Port))
+	}
+	if rd.PasswordSecretKeyRef != nil {
+		password, err := r.secretKeyValue(ctx, cr.Namespace, rd.PasswordSecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("redis.external.passwordSecretKeyRef: %w", err)
+		}
+		c.Password = password
+	}
+	return c, nil
+}
+
+// ResolveTurnConfig returns the TURN settings for Synapse. For a managed
+// coturn server, it returns nil until the server's address is known.
+func (r *SynapseReconciler) resolveTurnConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, tu *matrixv1alpha1.SynapseTurn) (*synapseconf.TurnConfig, error) {
+	if tu.Managed && tu.External != nil {
+		return nil, invalidSpecf("turn.managed and turn.external are mutually exclusive")
+	}
+	if tu.UserLifetime != "" && !synapseconf.IsDuration(tu.UserLifetime) {
+		return nil, invalidSpecf("turn.userLifetime: %q is not a duration", tu.UserLifetime)
+	}
+	c := &synapseconf.TurnConfig{
+		UserLifetime: tu.UserLifetime,
+		AllowGuests:  tu.AllowGuests,
+	}
+
+	switch {
+	case tu.External != nil:
+		ext := tu.External
+		if len(ext.URIs) == 0 {
+			return nil, invalidSpecf("turn.external.uris must not be empty")
+		}
+		for i, uri := range ext.URIs {
+			if !strings.HasPrefix(uri, "turn:") && !strings.HasPrefix(uri, "turns:") {
+				return nil, invalidSpecf("turn.external.uris[%d]: %q is not a turn: or turns: URI", i, uri)
+			}
+		}
+		if ext.SharedSecretKeyRef == nil {
+			return nil, invalidSpecf("turn.external.sharedSecretKeyRef must be set")
+		}
+		secret, err := r.secretKeyValue(ctx, cr.Namespace, ext.SharedSecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("turn.external.sharedSecretKeyRef: %w", err)
+		}
+		c.URIs = ext.URIs
+		c.SharedSecret = secret
+
+	case tu.Managed:
+		svc := &v1.Service{}
+		err := r.Get(ctx, types.NamespacedName{
+			Name:      managedCoturnName(cr),
+			Namespace: cr.Namespace,
+		}, svc)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("managed coturn Service: %w", err)
+		}
+		address := coturnAddress(cr, svc)
+		if address == "" {
+			// The load balancer hasn't assigned an address yet.
+			// Its arrival triggers another reconcile.
+			return nil, nil
+		}
+		secret, err := r.secretKeyValue(ctx, cr.Namespace, managedCoturnSecretKeyRef(cr))
+		if err != nil {
+			return nil, fmt.Errorf("managed coturn shared secret: %w", err)
+		}
+		c.URIs = managedTurnURIs(address)
+		c.SharedSecret = secret
+
+	default:
+		return nil, invalidSpecf("turn needs one of managed or external")
+	}
+	return c, nil
+}
+
+func (r *SynapseReconciler) resolveRegistrationConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, reg *matrixv1alpha1.SynapseRegistration) (*synapseconf.RegistrationConfig, error) {
+	for _, m := range reg.RequiredThreepids {
+		if m == matrixv1alpha1.ThreepidEmail && cr.Spec.Email == nil {
+			return nil, invalidSpecf("registration.requiredThreepids: email verification requires spec.email")
+		}
+	}
+
+	c := reg.SynapseConfig()
+	if rc := reg.Recaptcha; rc != nil {
+		if rc.PublicKeySecretKeyRef == nil || rc.PrivateKeySecretKeyRef == nil {
+			return nil, invalidSpecf("registration.recaptcha: publicKeySecretKeyRef and privateKeySecretKeyRef must be set")
+		}
+		public, err := r.secretKeyValue(ctx, cr.Namespace, rc.PublicKeySecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("registration.recaptcha.publicKeySecretKeyRef: %w", err)
+		}
+		private, err := r.secretKeyValue(ctx, cr.Namespace, rc.PrivateKeySecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("registration.recaptcha.privateKeySecretKeyRef: %w", err)
+		}
+		c.RecaptchaPublicKey = public
+		c.RecaptchaPrivateKey = private
+	}
+	if err := synapseconf.ValidateRegistrationConfig(c); err != nil {
+		return nil, invalidSpecf("registration: %v", err)
+	}
+	return c, nil
+}
+
+func (r *SynapseReconciler) resolveOIDCProviders(ctx context.Context, cr *matrixv1alpha1.Synapse, providers []matrixv1alpha1.OIDCProvider) ([]synapseconf.OIDCProviderConfig, error) {
+	var out []synapseconf.OIDCProviderConfig
+	for i, p := range providers {
+		c := p.SynapseConfig()
+		if p.ClientSecretSecretKeyRef != nil {
+			secret, err := r.secretKeyValue(ctx, cr.Namespace, p.ClientSecretSecretKeyRef)
+			if err != nil {
+				return nil, fmt.Errorf("sso.oidcProviders[%d].clientSecretSecretKeyRef: %w", i, err)
+			}
+			c.ClientSecret = secret
+		}
+		out = append(out, c)
+	}
+	if err := synapseconf.ValidateOIDCProviders(out); err != nil {
+		return nil, invalidSpecf("sso.oidcProviders: %v", err)
+	}
+	return out, nil
+}
+
+func (r *SynapseReconciler) resolveS3StorageConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, s3 *matrixv1alpha1.MediaS3) (*synapseconf.S3StorageConfig, error) {
+	if s3.Bucket == "" {
+		return nil, invalidSpecf("media.s3.bucket must not be empty")
+	}
+	if s3.EndpointURL != "" {
+		u, err := url.Parse(s3.EndpointURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, invalidSpecf("media.s3.endpointURL: %q is not an http(s) URL", s3.EndpointURL)
+		}
+	}
+	if (s3.AccessKeyIDSecretKeyRef == nil) != (s3.SecretAccessKeySecretKeyRef == nil) {
+		return nil, invalidSpecf("media.s3: accessKeyIDSecretKeyRef and secretAccessKeySecretKeyRef must be set together")
+	}
+
+	c := &synapseconf.S3StorageConfig{
+		Bucket:      s3.Bucket,
+		EndpointURL: s3.EndpointURL,
+		Region:      s3.Region,
+	}
+	if s3.AccessKeyIDSecretKeyRef != nil {
+		id, err := r.secretKeyValue(ctx, cr.Namespace, s3.AccessKeyIDSecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("media.s3.accessKeyIDSecretKeyRef: %w", err)
+		}
+		key, err := r.secretKeyValue(ctx, cr.Namespace, s3.SecretAccessKeySecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("media.s3.secretAccessKeySecretKeyRef: %w", err)
+		}
+		c.AccessKeyID = id
+		c.SecretAccessKey = key
+	}
+	return c, nil
+}
+
+func (r *SynapseReconciler) resolveEmailConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, em *matrixv1alpha1.SynapseEmail) (*synapseconf.EmailConfig, error) {
+	if em.SMTPHost == "" {
+		return nil, invalidSpecf("email.smtpHost must not be empty")
+	}
+	if em.SMTPPort < 0 || em.SMTPPort > 65535 {
+		return nil, invalidSpecf("email.smtpPort: %d out of range", em.SMTPPort)
+	}
+	if err := synapseconf.ValidateNotifFrom(em.NotifFrom); err != nil {
+		return nil, invalidSpecf("email.notifFrom: %v", err)
+	}
+	if (em.UserSecretKeyRef == nil) != (em.PasswordSecretKeyRef == nil) {
+		return nil, invalidSpecf("email.userSecretKeyRef and email.passwordSecretKeyRef must be set together")
+	}
+
+	c := &synapseconf.EmailConfig{
+		SMTPHost:     em.SMTPHost,
+		NotifFrom:    em.NotifFrom,
+		AppName:      em.AppName,
+		EnableNotifs: em.EnableNotifs,
+	}
+	if em.SMTPPort != 0 {
+		c.SMTPPort = strconv.Itoa(int(em.SMTPPort))
+	}
+	switch em.TLSMode {
+	case "", matrixv1alpha1.EmailTLSOpportunistic:
+	case matrixv1alpha1.EmailTLSStartTLS:
+		c.RequireTransportSecurity = true
+	case matrixv1alpha1.EmailTLSTLS:
+		c.ForceTLS = true
+	default:
+		return nil, invalidSpecf("email.tlsMode: unknown mode %q", em.TLSMode)
+	}
+	if em.UserSecretKeyRef != nil {
+		user, err := r.secretKeyValue(ctx, cr.Namespace, em.UserSecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("email.userSecretKeyRef: %w", err)
+		}
+		password, err := r.secretKeyValue(ctx, cr.Namespace, em.PasswordSecretKeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("email.passwordSecretKeyRef: %w", err)
+		}
+		c.SMTPUser = user
+		c.SMTPPass = password
+	}
+	return c, nil
+}
+
+func (r *SynapseReconciler) resolvePostgresConfig(ctx context.Context, cr *matrixv1alpha1.Synapse, pg *matrixv1alpha1.PostgresDatabase) (*synapseconf.PostgresConfig, error) {
+	if pg.Host == "" {
+		return nil, invalidSpecf("database.postgres.host must not be empty")
+	}
+	if pg.Port < 0 || pg.Port > 65535 {
+		return nil, invalidSpecf("database.postgres.port: %d out of range", pg.Port)
+	}
+	password, err := r.secretKeyValue(ctx, cr.Namespace, &pg.PasswordSecretKeyRef)
+	if err != nil {
+		return nil, fmt.Errorf("database.postgres.passwordSecretKeyRef: %w", err)
+	}
+
+	c := &synapseconf.PostgresConfig{
+		User:     pg.User,
+		Password: password,
+		Database: pg.Database,
+		Host:     pg.Host,
+	}
+	if pg.Port != 0 {
+		c.Port = strconv.Itoa(int(pg.Port))
+	}
+	return c, nil
+}
+
+// SecretKeyValue returns the value stored under the key selected by sel.
+func (r *SynapseReconciler) secretKeyValue(ctx context.Context, namespace string, sel *v1.SecretKeySelector) (string, error) {
+	if sel.Name == "" || sel.Key == "" {
+		return "", invalidSpecf("secret key selector needs both name and key")
+	}
+
+	secret := &v1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      sel.Name,
+		Namespace: namespace,
+	}, secret)
+	if err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[sel.Key]
+	if !ok {
+		return "", &missingKeyError{fmt.Sprintf("secret %s/%s has no key %q", namespace, sel.Name, sel.Key)}
+	}
+	return string(value), nil
+}
+
+// ConfigMapKeyValue returns the value stored under the key selected by sel.
+func (r *SynapseReconciler) configMapKeyValue(ctx context.Context, namespace string, sel *v1.ConfigMapKeySelector) (string, error) {
+	if sel.Name == "" || sel.Key == "" {
+		return "", invalidSpecf("config map key selector needs both name and key")
+	}
+
+	cm := &v1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      sel.Name,
+		Namespace: namespace,
+	}, cm)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := cm.Data[sel.Key]; ok {
+		return value, nil
+	}
+	if value, ok := cm.BinaryData[sel.Key]; ok {
+		return string(value), nil
+	}
+	return "", &missingKeyError{fmt.Sprintf("config map %s/%s has no key %q", namespace, sel.Name, sel.Key)}
+}
+
+// A missingKeyError reports a Secret or ConfigMap key that doesn't exist.
+type missingKeyError struct {
+	msg string
+}
+
+func (e *missingKeyError) Error() string {
+	return e.msg
+}
+
+// IsMissingKey reports whether err was caused by a Secret or ConfigMap, or
+// a key therein, that doesn't exist.
+func isMissingKey(err error) bool {
+	var e *missingKeyError
+	return errors.As(err, &e) || apierrors.IsNotFound(err)
+}
+
+// ReferencedConfigMaps returns the names of the user-managed ConfigMaps the
+// CR refers to.
+func referencedConfigMaps(cr *matrixv1alpha1.Synapse) []string {
+	var names []string
+	for _, src := range cr.Spec.ExtraConfig {
+		if src.ConfigMapKeyRef != nil {
+			names = append(names, src.ConfigMapKeyRef.Name)
+		}
+	}
+	if sel := cr.Spec.ConfigTemplate; sel != nil {
+		names = append(names, sel.Name)
+	}
+	return names
+}
+
+// ReferencedSecrets returns the names of the user-managed Secrets the CR
+// refers to.
+func referencedSecrets(cr *matrixv1alpha1.Synapse) []string {
+	var names []string
+	if db := cr.Spec.Database; db != nil && db.Postgres != nil {
+		names = append(names, db.Postgres.PasswordSecretKeyRef.Name)
+	}
+	if rd := cr.Spec.Redis; rd != nil && rd.External != nil && rd.External.PasswordSecretKeyRef != nil {
+		names = append(names, rd.External.PasswordSecretKeyRef.Name)
+	}
+	for _, src := range cr.Spec.ExtraConfig {
+		if src.SecretKeyRef != nil {
+			names = append(names, src.SecretKeyRef.Name)
+		}
+	}
+	// Secrets read by the config template can't be known from the spec.
+	names = append(names, cr.Status.TemplateSecrets...)
+	if sec := cr.Spec.Secrets; sec != nil && sec.ExistingSecretName != "" {
+		names = append(names, sec.ExistingSecretName)
+	}
+	if tu := cr.Spec.Turn; tu != nil && tu.External != nil && tu.External.SharedSecretKeyRef != nil {
+		names = append(names, tu.External.SharedSecretKeyRef.Name)
+	}
+	if reg := cr.Spec.Registration; reg != nil && reg.Recaptcha != nil {
+		for _, sel := range []*v1.SecretKeySelector{reg.Recaptcha.PublicKeySecretKeyRef, reg.Recaptcha.PrivateKeySecretKeyRef} {
+			if sel != nil {
+				names = append(names, sel.Name)
+			}
+		}
+	}
+	if sso := cr.Spec.SSO; sso != nil {
+		for _, p := range sso.OIDCProviders {
+			if p.ClientSecretSecretKeyRef != nil {
+				names = append(names, p.ClientSecretSecretKeyRef.Name)
+			}
+		}
+	}
+	if md := cr.Spec.Media; md != nil && md.S3 != nil {
+		for _, sel := range []*v1.SecretKeySelector{md.S3.AccessKeyIDSecretKeyRef, md.S3.SecretAccessKeySecretKeyRef} {
+			if sel != nil {
+				names = append(names, sel.Name)
+			}
+		}
+	}
+	if em := cr.Spec.Email; em != nil {
+		for _, sel := range []*v1.SecretKeySelector{em.UserSecretKeyRef, em.PasswordSecretKeyRef} {
+			if sel != nil {
+				names = append(names, sel.Name)
+			}
+		}
+	}
+	return names
+}
+
+// ReferencingSynapses returns a function mapping an object to reconcile
+// requests for the Synapse CRs in its namespace that refer to it, as
+// determined by refsOf.
+func (r *SynapseReconciler) referencingSynapses(refsOf func(*matrixv1alpha1.Synapse) []string) handler.ToRequestsFunc {
+	return func(a handler.MapObject) []reconcile.Request {
+		list := &matrixv1alpha1.SynapseList{}
+		err := r.List(context.Background(), list, client.InNamespace(a.Meta.GetNamespace()))
+		if err != nil {
+			r.Log.Error(err, "list Synapses", "namespace", a.Meta.GetNamespace())
+			return nil
+		}
+
+		var reqs []reconcile.Request
+		for i := range list.Items {
+			cr := &list.Items[i]
+			for _, name := range refsOf(cr) {
+				if name == a.Meta.GetName() {
+					reqs = append(reqs, reconcile.Request{
+						NamespacedName: types.NamespacedName{
+							Name:      cr.Name,
+							Namespace: cr.Namespace,
+						},
+					})
+					break
+				}
+			}
+		}
+		return reqs
+	}
+}
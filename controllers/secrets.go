@@ -0,0 +1,154 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+)
+
+// Secret keys holding the random secrets Synapse needs.
+const (
+	registrationSharedSecretKey = "registration-shared-secret"
+	macaroonSecretKeyKey        = "macaroon-secret-key"
+	formSecretKey               = "form-secret"
+)
+
+// GeneratedSecretKeys lists the keys of the Synapse Secret holding random
+// strings generated by the operator.
+var generatedSecretKeys = []string{
+	registrationSharedSecretKey,
+	macaroonSecretKeyKey,
+	formSecretKey,
+}
+
+// CheckGeneratedSecrets returns an error if secret lacks one of the
+// generated secrets. Synapse would otherwise get a fresh random value each
+// time homeserver.yaml is generated.
+func checkGeneratedSecrets(secret *v1.Secret) error {
+	for _, key := range generatedSecretKeys {
+		if len(secret.Data[key]) == 0 {
+			return fmt.Errorf("missing key %q", key)
+		}
+	}
+	return nil
+}
+
+// SecretRotationAnnotationPrefix, followed by a key of the Synapse Secret,
+// records on the Secret the value of spec.secrets.rotate the secret was
+// generated for.
+const secretRotationAnnotationPrefix = "matrix.slrz.net/rotation-"
+
+// SecretRotatedAnnotationPrefix, followed by a key of the Synapse Secret,
+// records on the Secret when the operator last regenerated the secret.
+const secretRotatedAnnotationPrefix = "matrix.slrz.net/rotated-"
+
+// RequestedSecretRotations returns the rotations requested through
+// spec.secrets.rotate, by key of the Synapse Secret, formatted as in the
+// rotation annotations.
+func requestedSecretRotations(cr *matrixv1alpha1.Synapse) map[string]string {
+	sec := cr.Spec.Secrets
+	if sec == nil || sec.Rotate == nil {
+		return nil
+	}
+	m := make(map[string]string)
+	for key, t := range map[string]*metav1.Time{
+		registrationSharedSecretKey: sec.Rotate.RegistrationSharedSecret,
+		macaroonSecretKeyKey:        sec.Rotate.MacaroonSecretKey,
+		formSecretKey:               sec.Rotate.FormSecret,
+	} {
+		if t != nil {
+			m[key] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	return m
+}
+
+// DueSecretRotations returns the keys of the secrets whose requested
+// rotation hasn't happened yet, in sorted order.
+func dueSecretRotations(cr *matrixv1alpha1.Synapse, secret *v1.Secret) []string {
+	var keys []string
+	for key, want := range requestedSecretRotations(cr) {
+		if secret.Annotations[secretRotationAnnotationPrefix+key] != want {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RotateSecrets replaces the values of the given keys in secret with new
+// random strings, recording now as their rotation time.
+func rotateSecrets(cr *matrixv1alpha1.Synapse, secret *v1.Secret, keys []string, now time.Time) error {
+	requested := requestedSecretRotations(cr)
+	for _, key := range keys {
+		value, err := randomString(64)
+		if err != nil {
+			return err
+		}
+		secret.Data[key] = []byte(value)
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		secret.Annotations[secretRotationAnnotationPrefix+key] = requested[key]
+		secret.Annotations[secretRotatedAnnotationPrefix+key] = now.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// SecretRotationStatus reports the last rotation of each secret, as
+// recorded on the Synapse Secret.
+func secretRotationStatus(secret *v1.Secret) []matrixv1alpha1.SecretRotationStatus {
+	var st []matrixv1alpha1.SecretRotationStatus
+	for _, key := range generatedSecretKeys {
+		ts := secret.Annotations[secretRotatedAnnotationPrefix+key]
+		if ts == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			continue
+		}
+		st = append(st, matrixv1alpha1.SecretRotationStatus{
+			Key:          key,
+			LastRotation: metav1.Time{Time: t},
+		})
+	}
+	return st
+}
+
+// RotationAnnotations returns the annotations marking the rotations
+// requested by cr as done, for a newly created Synapse Secret.
+func rotationAnnotations(cr *matrixv1alpha1.Synapse) map[string]string {
+	m := make(map[string]string)
+	if ts := requestedRotation(cr); ts != "" {
+		m[signingKeyRotationAnnotationKey] = ts
+	}
+	for key, ts := range requestedSecretRotations(cr) {
+		m[secretRotationAnnotationPrefix+key] = ts
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
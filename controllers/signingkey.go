@@ -0,0 +1,166 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+// SigningKeyRotationAnnotationKey records on the Secret the value of
+// spec.signingKey.rotate its signing key was generated for.
+const signingKeyRotationAnnotationKey = "matrix.slrz.net/signing-key-rotation"
+
+// SigningKeyRotatedAnnotationKey records on the Secret when the current
+// signing key replaced the previous one, which is also when the previous
+// one expired.
+const signingKeyRotatedAnnotationKey = "matrix.slrz.net/signing-key-rotated"
+
+// Secret keys holding the current signing key and the verify keys of
+// retired ones.
+const (
+	signingKeySecretKey     = "signing-key"
+	oldSigningKeysSecretKey = "old-signing-keys"
+)
+
+// NewSigningKey returns a signing key file holding a newly generated key
+// with a random version of the form a_XXXX.
+func newSigningKey() ([]byte, error) {
+	var version string
+	for {
+		// We don't want '-' or '_' in the resulting version, so
+		// retry until we get what we desire.
+		id, err := randomString(4)
+		if err != nil {
+			return nil, err
+		}
+		if strings.IndexAny(id, "-_") == -1 {
+			version = "a_" + id
+			break
+		}
+	}
+	key, err := synapseconf.GenerateSigningKey(version)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing key: %w", err)
+	}
+	return key, nil
+}
+
+// RequestedRotation returns the value of spec.signingKey.rotate as recorded
+// in signingKeyRotationAnnotationKey, or the empty string if it's unset.
+func requestedRotation(cr *matrixv1alpha1.Synapse) string {
+	if sk := cr.Spec.SigningKey; sk != nil && sk.Rotate != nil {
+		return sk.Rotate.UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// SigningKeyRotationDue reports whether spec.signingKey.rotate asks for a
+// signing key rotation that hasn't happened yet.
+func signingKeyRotationDue(cr *matrixv1alpha1.Synapse, secret *v1.Secret) bool {
+	want := requestedRotation(cr)
+	return want != "" && want != secret.Annotations[signingKeyRotationAnnotationKey]
+}
+
+// RotateSigningKey replaces the signing key stored in secret by a new one
+// and adds the verify keys of the replaced ones, expired at now, to the
+// old signing keys.
+func rotateSigningKey(cr *matrixv1alpha1.Synapse, secret *v1.Secret, now time.Time) error {
+	keys, err := synapseconf.ParseSigningKeys(secret.Data[signingKeySecretKey])
+	if err != nil {
+		return fmt.Errorf("current signing key: %w", err)
+	}
+	old, err := synapseconf.ParseOldSigningKeys(secret.Data[oldSigningKeysSecretKey])
+	if err != nil {
+		return fmt.Errorf("old signing keys: %w", err)
+	}
+	// Synapse expects expiry timestamps in milliseconds.
+	now = now.Truncate(time.Millisecond)
+	expired := now.UnixNano() / int64(time.Millisecond)
+	for i := range keys {
+		vk, err := keys[i].VerifyKey()
+		if err != nil {
+			return err
+		}
+		old[keys[i].KeyID()] = synapseconf.OldSigningKey{
+			Key:       vk,
+			ExpiredTS: expired,
+		}
+	}
+
+	var key []byte
+	for {
+		if key, err = newSigningKey(); err != nil {
+			return err
+		}
+		// Key IDs must never be reused.
+		newKeys, err := synapseconf.ParseSigningKeys(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := old[newKeys[0].KeyID()]; !ok {
+			break
+		}
+	}
+	oldYAML, err := synapseconf.FormatOldSigningKeys(old)
+	if err != nil {
+		return err
+	}
+
+	secret.Data[signingKeySecretKey] = key
+	secret.Data[oldSigningKeysSecretKey] = oldYAML
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	secret.Annotations[signingKeyRotationAnnotationKey] = requestedRotation(cr)
+	secret.Annotations[signingKeyRotatedAnnotationKey] = now.UTC().Format(time.RFC3339Nano)
+	return nil
+}
+
+// SigningKeyState inspects the signing keys stored in secret. It returns
+// the status of the current signing key and the verify keys of the old
+// ones.
+func signingKeyState(secret *v1.Secret) (*matrixv1alpha1.SigningKeyStatus, map[string]synapseconf.OldSigningKey, error) {
+	keys, err := synapseconf.ParseSigningKeys(secret.Data[signingKeySecretKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing key: %w", err)
+	}
+	old, err := synapseconf.ParseOldSigningKeys(secret.Data[oldSigningKeysSecretKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("old signing keys: %w", err)
+	}
+	if len(old) == 0 {
+		old = nil
+	}
+
+	st := &matrixv1alpha1.SigningKeyStatus{
+		KeyID: keys[0].KeyID(),
+	}
+	if ts := secret.Annotations[signingKeyRotatedAnnotationKey]; ts != "" {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			st.LastRotation = &metav1.Time{Time: t}
+		}
+	}
+	return st, old, nil
+}
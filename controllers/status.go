@@ -0,0 +1,148 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+)
+
+// Condition reasons. These are part of the API, don't change them.
+const (
+	reasonCreating            = "Creating"
+	reasonSecretAvailable     = "SecretAvailable"
+	reasonInvalidSecret       = "InvalidSecret"
+	reasonConfigUpToDate      = "UpToDate"
+	reasonConfigOutdated      = "Outdated"
+	reasonInvalidSpec         = "InvalidSpec"
+	reasonReferenceError      = "ReferenceError"
+	reasonGenerationFailed    = "GenerationFailed"
+	reasonTemplateError       = "TemplateError"
+	reasonSQLite              = "SQLite"
+	reasonExternalDatabase    = "ExternalDatabase"
+	reasonDatabaseReady       = "StatefulSetReady"
+	reasonManagedNotReady     = "StatefulSetNotReady"
+	reasonWaitingForDatabase  = "WaitingForDatabase"
+	reasonDeploymentNoStatus  = "NoStatus"
+	reasonReconcileFailed     = "ReconcileFailed"
+	reasonReconcileSucceeded  = "ReconcileSucceeded"
+	reasonDeploymentAvailable = "MinimumReplicasAvailable"
+	reasonModuleFound         = "ModuleFound"
+	reasonModuleMissing       = "ModuleMissing"
+	reasonCheckingModule      = "CheckingModule"
+)
+
+// Reasons for Warning events. Normal events use the kind of the affected
+// object followed by Created, Updated or Deleted, e.g. ConfigMapUpdated.
+const (
+	eventReasonCreateFailed              = "CreateFailed"
+	eventReasonUpdateFailed              = "UpdateFailed"
+	eventReasonDeleteFailed              = "DeleteFailed"
+	eventReasonGetFailed                 = "GetFailed"
+	eventReasonApplyFailed               = "ApplyFailed"
+	eventReasonConfigGenerationFailed    = "ConfigGenerationFailed"
+	eventReasonSecretGenerationFailed    = "SecretGenerationFailed"
+	eventReasonInvalidSecret             = "InvalidSecret"
+	eventReasonAccessTokensInvalidated   = "AccessTokensInvalidated"
+	eventReasonReferenceError            = "ReferenceError"
+	eventReasonMediaStorageModuleMissing = "MediaStorageModuleMissing"
+	eventReasonInvalidSpec               = "InvalidSpec"
+	eventReasonStatusUpdateFailed        = "StatusUpdateFailed"
+)
+
+// SetCondition records a condition of the given type on the CR's status.
+func setCondition(cr *matrixv1alpha1.Synapse, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	matrixv1alpha1.SetCondition(&cr.Status.Conditions, matrixv1alpha1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: cr.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// SetDeploymentAvailableCondition mirrors the Available condition of the
+// Synapse Deployment.
+func setDeploymentAvailableCondition(cr *matrixv1alpha1.Synapse, dep *appsv1.Deployment) {
+	for _, c := range dep.Status.Conditions {
+		if c.Type != appsv1.DeploymentAvailable {
+			continue
+		}
+		reason := c.Reason
+		if reason == "" {
+			reason = reasonDeploymentAvailable
+		}
+		setCondition(cr, matrixv1alpha1.ConditionDeploymentAvailable,
+			metav1.ConditionStatus(c.Status), reason, c.Message)
+		return
+	}
+	setCondition(cr, matrixv1alpha1.ConditionDeploymentAvailable,
+		metav1.ConditionUnknown, reasonDeploymentNoStatus,
+		"Deployment doesn't report availability yet")
+}
+
+// SetDatabaseReadyCondition records whether the database is usable. We only
+// know for sure in case of a managed database; SQLite and external databases
+// are assumed to be ready.
+func setDatabaseReadyCondition(cr *matrixv1alpha1.Synapse) {
+	switch db := cr.Spec.Database; {
+	case managesPostgres(cr):
+		if st := cr.Status.Database; st != nil && st.Ready {
+			setCondition(cr, matrixv1alpha1.ConditionDatabaseReady,
+				metav1.ConditionTrue, reasonDatabaseReady, "")
+		} else {
+			setCondition(cr, matrixv1alpha1.ConditionDatabaseReady,
+				metav1.ConditionFalse, reasonManagedNotReady,
+				"managed database not ready yet")
+		}
+	case db != nil && db.Postgres != nil:
+		setCondition(cr, matrixv1alpha1.ConditionDatabaseReady,
+			metav1.ConditionTrue, reasonExternalDatabase, "")
+	default:
+		setCondition(cr, matrixv1alpha1.ConditionDatabaseReady,
+			metav1.ConditionTrue, reasonSQLite, "")
+	}
+}
+
+// SetDegradedCondition records the outcome of a reconciliation.
+func setDegradedCondition(cr *matrixv1alpha1.Synapse, err error) {
+	switch {
+	case err == nil:
+		setCondition(cr, matrixv1alpha1.ConditionDegraded,
+			metav1.ConditionFalse, reasonReconcileSucceeded, "")
+	case isInvalidSpec(err):
+		setCondition(cr, matrixv1alpha1.ConditionDegraded,
+			metav1.ConditionTrue, reasonInvalidSpec, err.Error())
+	default:
+		setCondition(cr, matrixv1alpha1.ConditionDegraded,
+			metav1.ConditionTrue, reasonReconcileFailed, err.Error())
+	}
+}
+
+// SynapsePhase summarizes the conditions in st.
+func synapsePhase(st *matrixv1alpha1.SynapseStatus) matrixv1alpha1.SynapsePhase {
+	switch {
+	case matrixv1alpha1.IsConditionTrue(st.Conditions, matrixv1alpha1.ConditionDegraded):
+		return matrixv1alpha1.SynapseDegraded
+	case matrixv1alpha1.IsConditionTrue(st.Conditions, matrixv1alpha1.ConditionDeploymentAvailable):
+		return matrixv1alpha1.SynapseRunning
+	default:
+		return matrixv1alpha1.SynapsePending
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+)
+
+var defaultStorageSize = resource.MustParse("10Gi")
+
+// DataClaimName returns the name of the persistent volume claim mounted as
+// Synapse's data directory or the empty string if the CR doesn't ask for
+// persistent storage.
+func dataClaimName(cr *matrixv1alpha1.Synapse) string {
+	st := cr.Spec.Storage
+	if st == nil {
+		return ""
+	}
+	if st.ExistingClaimName != "" {
+		return st.ExistingClaimName
+	}
+	return cr.Name
+}
+
+// OwnsDataClaim reports whether the operator is responsible for managing the
+// data volume claim (as opposed to using a user-provided one).
+func ownsDataClaim(cr *matrixv1alpha1.Synapse) bool {
+	st := cr.Spec.Storage
+	return st != nil && st.ExistingClaimName == ""
+}
+
+func requestedStorageSize(cr *matrixv1alpha1.Synapse) resource.Quantity {
+	if st := cr.Spec.Storage; st != nil && st.Size != nil {
+		return *st.Size
+	}
+	return defaultStorageSize
+}
+
+func synapsePersistentVolumeClaim(cr *matrixv1alpha1.Synapse) *v1.PersistentVolumeClaim {
+	st := cr.Spec.Storage
+	accessModes := st.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dataClaimName(cr),
+			Namespace: cr.Namespace,
+			Labels:    synapseLabels(cr.Name),
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: st.StorageClassName,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: requestedStorageSize(cr),
+				},
+			},
+		},
+	}
+}
+
+// ClaimNeedsExpansion reports whether the CR asks for more storage than
+// currently requested by the claim. Shrinking a claim is not supported by
+// Kubernetes, so a smaller size is silently ignored.
+func claimNeedsExpansion(cr *matrixv1alpha1.Synapse, pvc *v1.PersistentVolumeClaim) bool {
+	want := requestedStorageSize(cr)
+	got := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	return want.Cmp(got) > 0
+}
+
+// ClaimExpansionAllowed reports whether the storage class of the given claim
+// permits volume expansion.
+func (r *SynapseReconciler) claimExpansionAllowed(ctx context.Context, pvc *v1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+	sc := &storagev1.StorageClass{}
+	err := r.Get(ctx, types.NamespacedName{Name: *pvc.Spec.StorageClassName}, sc)
+	if err != nil {
+		return false, err
+	}
+	return sc.AllowVolumeExpansion != nil && *sc.AllowVolumeExpansion, nil
+}
+
+func storageStatus(pvc *v1.PersistentVolumeClaim) *matrixv1alpha1.StorageStatus {
+	st := &matrixv1alpha1.StorageStatus{
+		ClaimName: pvc.Name,
+		Phase:     pvc.Status.Phase,
+	}
+	if c, ok := pvc.Status.Capacity[v1.ResourceStorage]; ok {
+		st.Capacity = &c
+	}
+	return st
+}
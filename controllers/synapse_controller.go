@@ -23,36 +23,56 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
 	"github.com/slrz/synapse-operator/pkg/synapseconf"
 )
 
+// The field manager name used for server-side apply.
+const fieldManager = "synapse-operator"
+
 // SynapseReconciler reconciles a Synapse object
 type SynapseReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 // +kubebuilder:rbac:groups=matrix.slrz.net,resources=synapsis,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=matrix.slrz.net,resources=synapsis/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -70,15 +90,70 @@ func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
+	orig := synapse.Status.DeepCopy()
+	result, err := r.reconcile(ctx, log, synapse)
+
+	if isInvalidSpec(err) {
+		r.Recorder.Event(synapse, v1.EventTypeWarning, eventReasonInvalidSpec, err.Error())
+	}
+
+	// Record the outcome in the status subresource.
+	setDegradedCondition(synapse, err)
+	synapse.Status.ObservedGeneration = synapse.Generation
+	synapse.Status.Phase = synapsePhase(&synapse.Status)
+	if !reflect.DeepEqual(orig, &synapse.Status) {
+		if uerr := r.Status().Update(ctx, synapse); uerr != nil {
+			log.Error(uerr, "update Synapse status")
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonStatusUpdateFailed,
+				"update status: %v", uerr)
+			if err == nil {
+				return ctrl.Result{}, uerr
+			}
+		}
+	}
+
+	if isInvalidSpec(err) {
+		// Retrying won't help, wait for the spec to change.
+		return ctrl.Result{}, nil
+	}
+	return result, err
+}
+
+// Reconcile drives the cluster state towards the one described by the
+// Synapse resource. It updates synapse.Status along the way but leaves
+// persisting it to the caller.
+func (r *SynapseReconciler) reconcile(ctx context.Context, log logr.Logger, synapse *matrixv1alpha1.Synapse) (ctrl.Result, error) {
 	// Create secret if it doesn't exist yet
 	secret := &v1.Secret{}
-	err = r.Get(ctx, types.NamespacedName{
+	err := r.Get(ctx, types.NamespacedName{
 		Name:      synapse.Name,
 		Namespace: synapse.Namespace,
 	}, secret)
 	if err != nil && errors.IsNotFound(err) {
-		// Need to create it
-		secret := synapseSecret(synapse)
+		// Need to create it, possibly from values the user supplied.
+		imported, err := r.importedSecretData(ctx, synapse)
+		if err != nil {
+			log.Error(err, "import existing Secret")
+			reason := reasonReferenceError
+			if isInvalidSpec(err) {
+				reason = reasonInvalidSpec
+			} else {
+				r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonReferenceError,
+					"import existing Secret: %v", err)
+			}
+			setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+				metav1.ConditionFalse, reason, err.Error())
+			return ctrl.Result{}, err
+		}
+		secret, err := synapseSecret(synapse, imported)
+		if err != nil {
+			log.Error(err, "generate Secret")
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonSecretGenerationFailed,
+				"generate Secret: %v", err)
+			setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+				metav1.ConditionFalse, reasonGenerationFailed, err.Error())
+			return ctrl.Result{}, err
+		}
 		ctrl.SetControllerReference(synapse, secret, r.Scheme)
 		log.Info("creating Secret",
 			"Secret.Namespace", secret.Namespace,
@@ -88,16 +163,320 @@ func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			log.Error(err, "create Secret",
 				"Secret.Namespace", secret.Namespace,
 				"Secret.Name", secret.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonCreateFailed,
+				"create Secret %s: %v", secret.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "SecretCreated",
+			"Created Secret %s", secret.Name)
+		setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+			metav1.ConditionFalse, reasonCreating, "")
 		// Secret created successfully - return and requeue
 		return ctrl.Result{Requeue: true}, nil
 	}
 	if err != nil {
 		log.Error(err, "get Secret")
+		r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonGetFailed,
+			"get Secret: %v", err)
+		return ctrl.Result{}, err
+	}
+
+	// Rotate the signing key if requested.
+	if signingKeyRotationDue(synapse, secret) {
+		log.Info("rotating signing key",
+			"Secret.Namespace", secret.Namespace,
+			"Secret.Name", secret.Name)
+		if err := rotateSigningKey(synapse, secret, time.Now()); err != nil {
+			log.Error(err, "rotate signing key",
+				"Secret.Namespace", secret.Namespace,
+				"Secret.Name", secret.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonSecretGenerationFailed,
+				"rotate signing key: %v", err)
+			setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+				metav1.ConditionFalse, reasonGenerationFailed, err.Error())
+			return ctrl.Result{}, err
+		}
+		err = r.Update(ctx, secret)
+		if err != nil {
+			log.Error(err, "update Secret",
+				"Secret.Namespace", secret.Namespace,
+				"Secret.Name", secret.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonUpdateFailed,
+				"update Secret %s: %v", secret.Name, err)
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "SigningKeyRotated",
+			"Rotated signing key in Secret %s", secret.Name)
+		return ctrl.Result{Requeue: true}, nil
+	}
+	// Likewise for the other secrets.
+	if keys := dueSecretRotations(synapse, secret); len(keys) > 0 {
+		log.Info("rotating secrets",
+			"Secret.Namespace", secret.Namespace,
+			"Secret.Name", secret.Name,
+			"keys", keys)
+		if err := rotateSecrets(synapse, secret, keys, time.Now()); err != nil {
+			log.Error(err, "rotate secrets",
+				"Secret.Namespace", secret.Namespace,
+				"Secret.Name", secret.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonSecretGenerationFailed,
+				"rotate secrets: %v", err)
+			setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+				metav1.ConditionFalse, reasonGenerationFailed, err.Error())
+			return ctrl.Result{}, err
+		}
+		err = r.Update(ctx, secret)
+		if err != nil {
+			log.Error(err, "update Secret",
+				"Secret.Namespace", secret.Namespace,
+				"Secret.Name", secret.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonUpdateFailed,
+				"update Secret %s: %v", secret.Name, err)
+			return ctrl.Result{}, err
+		}
+		for _, key := range keys {
+			if key == macaroonSecretKeyKey {
+				r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonAccessTokensInvalidated,
+					"Rotated %s, existing access tokens are no longer valid", key)
+			}
+		}
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "SecretsRotated",
+			"Rotated %s in Secret %s", strings.Join(keys, ", "), secret.Name)
+		return ctrl.Result{Requeue: true}, nil
+	}
+	keyStatus, oldSigningKeys, err := signingKeyState(secret)
+	if err == nil {
+		err = checkGeneratedSecrets(secret)
+	}
+	if err != nil {
+		log.Error(err, "inspect Secret",
+			"Secret.Namespace", secret.Namespace,
+			"Secret.Name", secret.Name)
+		r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonInvalidSecret,
+			"Secret %s: %v", secret.Name, err)
+		setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+			metav1.ConditionFalse, reasonInvalidSecret, err.Error())
+		return ctrl.Result{}, err
+	}
+	synapse.Status.SecretName = secret.Name
+	synapse.Status.SigningKey = keyStatus
+	synapse.Status.SecretRotations = secretRotationStatus(secret)
+	setCondition(synapse, matrixv1alpha1.ConditionSecretReady,
+		metav1.ConditionTrue, reasonSecretAvailable, "")
+
+	// Deploy the managed database, if requested.
+	if managesPostgres(synapse) {
+		_, created, err := r.createSecretIfNotExists(ctx, log, synapse,
+			managedPostgresName(synapse), synapsePostgresSecret)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if created {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		if err := r.apply(ctx, log, synapse, synapsePostgresService(synapse)); err != nil {
+			return ctrl.Result{}, err
+		}
+		sts := synapsePostgresStatefulSet(synapse)
+		if err := r.apply(ctx, log, synapse, sts); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		synapse.Status.Database = &matrixv1alpha1.DatabaseStatus{
+			Host:  managedPostgresName(synapse),
+			Ready: managedPostgresReady(sts),
+		}
+	} else {
+		synapse.Status.Database = nil
+	}
+	setDatabaseReadyCondition(synapse)
+
+	// Deploy the managed Redis server, if requested, or clean up after it.
+	if managesRedis(synapse) {
+		_, created, err := r.createSecretIfNotExists(ctx, log, synapse,
+			managedRedisName(synapse), synapseRedisSecret)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if created {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		created, err = r.createIfNotExists(ctx, log, synapse, synapseRedisService(synapse))
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if created {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		if err := r.apply(ctx, log, synapse, synapseRedisDeployment(synapse)); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		meta := metav1.ObjectMeta{
+			Name:      managedRedisName(synapse),
+			Namespace: synapse.Namespace,
+		}
+		for _, obj := range []object{
+			&appsv1.Deployment{ObjectMeta: meta},
+			&v1.Service{ObjectMeta: meta},
+			&v1.Secret{ObjectMeta: meta},
+		} {
+			deleted, err := r.deleteIfControlled(ctx, log, synapse, obj)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+	}
+
+	// Deploy the managed coturn server, if requested, or clean up after
+	// it.
+	if managesCoturn(synapse) {
+		if err := validateCoturn(synapse); err != nil {
+			log.Error(err, "validate coturn")
+			return ctrl.Result{}, err
+		}
+		coturnSecret, created, err := r.createSecretIfNotExists(ctx, log, synapse,
+			managedCoturnName(synapse), synapseCoturnSecret)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if created {
+			return ctrl.Result{Requeue: true}, nil
+		}
+
+		svc := synapseCoturnService(synapse)
+		if err := r.apply(ctx, log, synapse, svc); err != nil {
+			return ctrl.Result{}, err
+		}
+		coturnCM, err := synapseCoturnConfigMap(synapse)
+		if err != nil {
+			log.Error(err, "generate turnserver.conf")
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonConfigGenerationFailed,
+				"generate turnserver.conf: %v", err)
+			return ctrl.Result{}, err
+		}
+		if err := r.apply(ctx, log, synapse, coturnCM); err != nil {
+			return ctrl.Result{}, err
+		}
+		dep := synapseCoturnDeployment(synapse, coturnSecret, coturnCM, coturnAddress(synapse, svc))
+		if err := r.apply(ctx, log, synapse, dep); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		meta := metav1.ObjectMeta{
+			Name:      managedCoturnName(synapse),
+			Namespace: synapse.Namespace,
+		}
+		for _, obj := range []object{
+			&appsv1.Deployment{ObjectMeta: meta},
+			&v1.Service{ObjectMeta: meta},
+			&v1.ConfigMap{ObjectMeta: meta},
+			&v1.Secret{ObjectMeta: meta},
+		} {
+			deleted, err := r.deleteIfControlled(ctx, log, synapse, obj)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+	}
+
+	// Check whether the Synapse image contains the S3 storage provider,
+	// or clean up after the check. Synapse won't start without it, but
+	// the status tells why.
+	if storesMediaInS3(synapse) {
+		job := s3ModuleCheckJob(synapse)
+		image := job.Annotations[s3ModuleCheckImageAnnotationKey]
+		created, err := r.createIfNotExists(ctx, log, synapse, job)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if created {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		if job.Annotations[s3ModuleCheckImageAnnotationKey] != image {
+			// The image changed, check again.
+			deleted, err := r.deleteIfControlled(ctx, log, synapse, job,
+				client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+		if setMediaStorageReadyCondition(synapse, job) {
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonMediaStorageModuleMissing,
+				"image %s can't import s3_storage_provider", image)
+		}
+	} else {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s3ModuleCheckName(synapse),
+				Namespace: synapse.Namespace,
+			},
+		}
+		deleted, err := r.deleteIfControlled(ctx, log, synapse, job,
+			client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if deleted {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		matrixv1alpha1.RemoveCondition(&synapse.Status.Conditions, matrixv1alpha1.ConditionMediaStorageReady)
+	}
+
+	if err := validateWorkers(synapse); err != nil {
+		log.Error(err, "validate workers")
+		return ctrl.Result{}, err
+	}
+	if err := validateMedia(synapse); err != nil {
+		log.Error(err, "validate media")
 		return ctrl.Result{}, err
 	}
 
+	// Look up configuration values stored outside of the CR.
+	refs, err := r.resolveRefs(ctx, synapse)
+	if err != nil {
+		log.Error(err, "resolve references")
+		reason := reasonReferenceError
+		if isInvalidSpec(err) {
+			reason = reasonInvalidSpec
+		} else {
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonReferenceError,
+				"resolve references: %v", err)
+		}
+		setCondition(synapse, matrixv1alpha1.ConditionConfigReady,
+			metav1.ConditionFalse, reason, err.Error())
+		return ctrl.Result{}, err
+	}
+	refs.oldSigningKeys = oldSigningKeys
+
+	// Generate homeserver.yaml. The digest over it and the Secret,
+	// attached to the config map, allows us to detect when the config
+	// file has become stale.
+	config := homeserverConfigFromCR(synapse, secret, refs)
+	yamlBytes, err := r.homeserverYAML(ctx, synapse, config, refs)
+	if err != nil {
+		log.Error(err, "generate homeserver.yaml")
+		r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonConfigGenerationFailed,
+			"generate homeserver.yaml: %v", err)
+		reason := reasonGenerationFailed
+		if refs.configTemplate != "" {
+			reason = reasonTemplateError
+		}
+		setCondition(synapse, matrixv1alpha1.ConditionConfigReady,
+			metav1.ConditionFalse, reason, err.Error())
+		return ctrl.Result{}, err
+	}
+	wantDigest := configDigest(yamlBytes, secret)
+
 	// Ensure the config map exists…
 	cm := &v1.ConfigMap{}
 	err = r.Get(ctx, types.NamespacedName{
@@ -105,7 +484,7 @@ func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		Namespace: synapse.Namespace,
 	}, cm)
 	if err != nil && errors.IsNotFound(err) {
-		cm := synapseConfigMap(synapse, secret)
+		cm := synapseConfigMap(synapse, yamlBytes, wantDigest)
 		ctrl.SetControllerReference(synapse, cm, r.Scheme)
 		log.Info("creating ConfigMap",
 			"ConfigMap.Namespace", cm.Namespace,
@@ -115,29 +494,32 @@ func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			log.Error(err, "create ConfigMap",
 				"ConfigMap.Namespace", cm.Namespace,
 				"ConfigMap.Name", cm.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonCreateFailed,
+				"create ConfigMap %s: %v", cm.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "ConfigMapCreated",
+			"Created ConfigMap %s", cm.Name)
+		setCondition(synapse, matrixv1alpha1.ConditionConfigReady,
+			metav1.ConditionFalse, reasonCreating, "")
 		return ctrl.Result{Requeue: true}, nil
 	}
 	if err != nil {
 		log.Error(err, "get ConfigMap")
+		r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonGetFailed,
+			"get ConfigMap: %v", err)
 		return ctrl.Result{}, err
 	}
+	synapse.Status.ConfigMapName = cm.Name
 
 	// … and is still in sync with the CR spec.
-	config, wantDigest := homeserverConfigFromCR(synapse, secret)
 	if gotDigest := cm.Annotations[inputIDAnnotationKey]; wantDigest != gotDigest {
 		log.Info("ConfigMap needs update",
 			"ConfigMap.Namespace", cm.Namespace,
 			"ConfigMap.Name", cm.Name,
 			"wantDigest", wantDigest, "gotDigest", gotDigest)
-		yamlBytes, err := synapseconf.GenerateHomeserverYAML(config)
-		if err != nil {
-			log.Error(err, "update ConfigMap: GenerateHomeserverYAML",
-				"ConfigMap.Namespace", cm.Namespace,
-				"ConfigMap.Name", cm.Name)
-			return ctrl.Result{}, err
-		}
+		setCondition(synapse, matrixv1alpha1.ConditionConfigReady,
+			metav1.ConditionFalse, reasonConfigOutdated, "")
 		cm.Data["homeserver.yaml"] = string(yamlBytes)
 		cm.Annotations[inputIDAnnotationKey] = wantDigest
 		err = r.Update(ctx, cm)
@@ -145,11 +527,160 @@ func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			log.Error(err, "update ConfigMap",
 				"ConfigMap.Namespace", cm.Namespace,
 				"ConfigMap.Name", cm.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonUpdateFailed,
+				"update ConfigMap %s: %v", cm.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "ConfigMapUpdated",
+			"Updated ConfigMap %s", cm.Name)
 		// Updated CM - return and requeue
 		return ctrl.Result{Requeue: true}, nil
 	}
+	setCondition(synapse, matrixv1alpha1.ConditionConfigReady,
+		metav1.ConditionTrue, reasonConfigUpToDate, "")
+
+	// Back the data directory by a persistent volume if requested.
+	if claimName := dataClaimName(synapse); claimName != "" {
+		pvc := &v1.PersistentVolumeClaim{}
+		err = r.Get(ctx, types.NamespacedName{
+			Name:      claimName,
+			Namespace: synapse.Namespace,
+		}, pvc)
+		if err != nil && errors.IsNotFound(err) && ownsDataClaim(synapse) {
+			pvc := synapsePersistentVolumeClaim(synapse)
+			ctrl.SetControllerReference(synapse, pvc, r.Scheme)
+			log.Info("creating PersistentVolumeClaim",
+				"PersistentVolumeClaim.Namespace", pvc.Namespace,
+				"PersistentVolumeClaim.Name", pvc.Name)
+			err = r.Create(ctx, pvc)
+			if err != nil {
+				log.Error(err, "create PersistentVolumeClaim",
+					"PersistentVolumeClaim.Namespace", pvc.Namespace,
+					"PersistentVolumeClaim.Name", pvc.Name)
+				r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonCreateFailed,
+					"create PersistentVolumeClaim %s: %v", pvc.Name, err)
+				return ctrl.Result{}, err
+			}
+			r.Recorder.Eventf(synapse, v1.EventTypeNormal, "PersistentVolumeClaimCreated",
+				"Created PersistentVolumeClaim %s", pvc.Name)
+			return ctrl.Result{Requeue: true}, nil
+		}
+		if err != nil {
+			log.Error(err, "get PersistentVolumeClaim",
+				"PersistentVolumeClaim.Name", claimName)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonGetFailed,
+				"get PersistentVolumeClaim %s: %v", claimName, err)
+			return ctrl.Result{}, err
+		}
+
+		if ownsDataClaim(synapse) && claimNeedsExpansion(synapse, pvc) {
+			allowed, err := r.claimExpansionAllowed(ctx, pvc)
+			if err != nil {
+				log.Error(err, "get StorageClass",
+					"PersistentVolumeClaim.Namespace", pvc.Namespace,
+					"PersistentVolumeClaim.Name", pvc.Name)
+				r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonGetFailed,
+					"get StorageClass: %v", err)
+				return ctrl.Result{}, err
+			}
+			if allowed {
+				log.Info("expanding PersistentVolumeClaim",
+					"PersistentVolumeClaim.Namespace", pvc.Namespace,
+					"PersistentVolumeClaim.Name", pvc.Name)
+				pvc.Spec.Resources.Requests[v1.ResourceStorage] = requestedStorageSize(synapse)
+				err = r.Update(ctx, pvc)
+				if err != nil {
+					log.Error(err, "update PersistentVolumeClaim",
+						"PersistentVolumeClaim.Namespace", pvc.Namespace,
+						"PersistentVolumeClaim.Name", pvc.Name)
+					r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonUpdateFailed,
+						"update PersistentVolumeClaim %s: %v", pvc.Name, err)
+					return ctrl.Result{}, err
+				}
+				r.Recorder.Eventf(synapse, v1.EventTypeNormal, "PersistentVolumeClaimUpdated",
+					"Updated PersistentVolumeClaim %s", pvc.Name)
+				return ctrl.Result{Requeue: true}, nil
+			}
+			log.Info("PersistentVolumeClaim: storage class does not allow volume expansion, ignoring size change",
+				"PersistentVolumeClaim.Namespace", pvc.Namespace,
+				"PersistentVolumeClaim.Name", pvc.Name)
+		}
+
+		synapse.Status.Storage = storageStatus(pvc)
+	} else {
+		synapse.Status.Storage = nil
+	}
+
+	// Route traffic to Synapse.
+	if err := r.apply(ctx, log, synapse, synapseService(synapse)); err != nil {
+		return ctrl.Result{}, err
+	}
+	if wantsIngress(synapse) {
+		if err := r.apply(ctx, log, synapse, synapseIngress(synapse)); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		deleted, err := r.deleteIfControlled(ctx, log, synapse, &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      synapse.Name,
+				Namespace: synapse.Namespace,
+			},
+		})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if deleted {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	// Serve the .well-known documents delegating the server name, or
+	// clean up after them if no longer needed.
+	if delegatesServerName(synapse) {
+		if err := validateDelegation(synapse); err != nil {
+			log.Error(err, "validate delegation")
+			return ctrl.Result{}, err
+		}
+		docs, err := wellKnownDocuments(synapse)
+		if err != nil {
+			log.Error(err, "render .well-known documents")
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonConfigGenerationFailed,
+				"render .well-known documents: %v", err)
+			return ctrl.Result{}, err
+		}
+
+		// The ConfigMap goes first so that the documents are there
+		// by the time nginx starts.
+		for _, obj := range []object{
+			wellKnownConfigMap(synapse, docs),
+			wellKnownDeployment(synapse),
+			wellKnownService(synapse),
+			wellKnownIngress(synapse),
+		} {
+			if err := r.apply(ctx, log, synapse, obj); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	} else {
+		meta := metav1.ObjectMeta{
+			Name:      wellKnownName(synapse),
+			Namespace: synapse.Namespace,
+		}
+		for _, obj := range []object{
+			&networkingv1beta1.Ingress{ObjectMeta: meta},
+			&v1.Service{ObjectMeta: meta},
+			&appsv1.Deployment{ObjectMeta: meta},
+			&v1.ConfigMap{ObjectMeta: meta},
+		} {
+			deleted, err := r.deleteIfControlled(ctx, log, synapse, obj)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+	}
 
 	// Now that the prerequisites exist, ensure we have a deployment
 	dep := &appsv1.Deployment{}
@@ -157,37 +688,69 @@ func (r *SynapseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		Name:      synapse.Name,
 		Namespace: synapse.Namespace,
 	}, dep)
-	if err != nil && errors.IsNotFound(err) {
-		dep := synapseDeployment(synapse, secret, cm)
-		ctrl.SetControllerReference(synapse, dep, r.Scheme)
-		log.Info("creating Deployment",
-			"Deployment.Namespace", dep.Namespace,
-			"Deployment.Name", dep.Name)
-		err = r.Create(ctx, dep)
-		if err != nil {
-			log.Error(err, "create Deployment",
-				"Deployment.Namespace", dep.Namespace,
-				"Deployment.Name", dep.Name)
-			return ctrl.Result{}, err
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error(err, "get Deployment")
+		r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonGetFailed,
+			"get Deployment: %v", err)
+		return ctrl.Result{}, err
+	}
+	depExists := err == nil
+	if st := synapse.Status.Database; managesPostgres(synapse) && (st == nil || !st.Ready) {
+		// Leave the Deployment alone rather than rolling out pods
+		// that can't reach the database. We get triggered again once
+		// the StatefulSet's status changes.
+		log.Info("waiting for database to become ready")
+		if depExists {
+			setDeploymentAvailableCondition(synapse, dep)
+		} else {
+			setCondition(synapse, matrixv1alpha1.ConditionDeploymentAvailable,
+				metav1.ConditionFalse, reasonWaitingForDatabase, "")
 		}
-		return ctrl.Result{Requeue: true}, nil
+		return ctrl.Result{}, nil
 	}
-	dep, changed := reconcileSynapseDeployment(synapse, dep)
-	if changed {
-		log.Info("updating Deployment",
-			"Deployment.Namespace", dep.Namespace,
-			"Deployment.Name", dep.Name)
-		err = r.Update(ctx, dep)
+	if depExists {
+		err = r.prepareDeploymentStrategy(ctx, synapse, dep)
 		if err != nil {
-			log.Error(err, "update Deployment",
+			log.Error(err, "patch Deployment strategy",
 				"Deployment.Namespace", dep.Namespace,
 				"Deployment.Name", dep.Name)
+			r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonUpdateFailed,
+				"patch Deployment strategy %s: %v", dep.Name, err)
 			return ctrl.Result{}, err
 		}
-		return ctrl.Result{Requeue: true}, nil
 	}
 
-	return ctrl.Result{}, nil
+	// Server-side apply the complete desired state. This creates the
+	// Deployment if needed and restores all fields we own, while leaving
+	// alone those owned by other field managers.
+	want := synapseDeployment(synapse, secret, cm)
+	ctrl.SetControllerReference(synapse, want, r.Scheme)
+	err = r.Patch(ctx, want, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	if err != nil {
+		log.Error(err, "apply Deployment",
+			"Deployment.Namespace", want.Namespace,
+			"Deployment.Name", want.Name)
+		r.Recorder.Eventf(synapse, v1.EventTypeWarning, eventReasonApplyFailed,
+			"apply Deployment %s: %v", want.Name, err)
+		return ctrl.Result{}, err
+	}
+	if !depExists {
+		log.Info("created Deployment",
+			"Deployment.Namespace", want.Namespace,
+			"Deployment.Name", want.Name)
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "DeploymentCreated",
+			"Created Deployment %s", want.Name)
+	} else if want.ResourceVersion != dep.ResourceVersion {
+		log.Info("updated Deployment",
+			"Deployment.Namespace", want.Namespace,
+			"Deployment.Name", want.Name)
+		r.Recorder.Eventf(synapse, v1.EventTypeNormal, "DeploymentUpdated",
+			"Updated Deployment %s", want.Name)
+	}
+	setDeploymentAvailableCondition(synapse, want)
+
+	// Run the worker processes, if any.
+	return r.reconcileWorkers(ctx, log, synapse, secret, cm)
 }
 
 func (r *SynapseReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -195,58 +758,232 @@ func (r *SynapseReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		For(&matrixv1alpha1.Synapse{}).
 		Owns(&v1.Secret{}).
 		Owns(&v1.ConfigMap{}).
+		Owns(&v1.PersistentVolumeClaim{}).
+		Owns(&v1.Service{}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&batchv1.Job{}).
+		Owns(&networkingv1beta1.Ingress{}).
+		// Regenerate the config when referenced objects change.
+		Watches(&source.Kind{Type: &v1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.referencingSynapses(referencedConfigMaps),
+		}).
+		Watches(&source.Kind{Type: &v1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.referencingSynapses(referencedSecrets),
+		}).
 		Complete(r)
 }
 
-func synapseSecret(cr *matrixv1alpha1.Synapse) *v1.Secret {
-	var keyID string
-	for {
-		// We don't want '-' or '_' in the resulting keyID, so retry
-		// until we get what we desire.
-		keyID = randomString(4)
-		if strings.IndexAny(keyID, "-_") == -1 {
-			break
-		}
+// An object is a Kubernetes API object with metadata.
+type object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// Apply creates or updates obj using server-side apply. Obj must have its
+// TypeMeta set.
+func (r *SynapseReconciler) apply(ctx context.Context, log logr.Logger, cr *matrixv1alpha1.Synapse, obj object) error {
+	kind := reflect.TypeOf(obj).Elem().Name()
+	cur := obj.DeepCopyObject().(object)
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}, cur)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error(err, "get "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonGetFailed,
+			"get %s %s: %v", kind, obj.GetName(), err)
+		return err
 	}
-	signingKey, err := synapseconf.GenerateSigningKey(fmt.Sprintf("a_%s", keyID))
+	exists := err == nil
+
+	ctrl.SetControllerReference(cr, obj, r.Scheme)
+	err = r.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	if err != nil {
+		log.Error(err, "apply "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonApplyFailed,
+			"apply %s %s: %v", kind, obj.GetName(), err)
+		return err
+	}
+	if !exists {
+		log.Info("created "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeNormal, kind+"Created",
+			"Created %s %s", kind, obj.GetName())
+	} else if obj.GetResourceVersion() != cur.GetResourceVersion() {
+		log.Info("updated "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeNormal, kind+"Updated",
+			"Updated %s %s", kind, obj.GetName())
+	}
+	return nil
+}
+
+// CreateIfNotExists creates obj unless an object of the same kind, name and
+// namespace already exists. In that case, the existing object is read into
+// obj. It reports whether obj was created.
+func (r *SynapseReconciler) createIfNotExists(ctx context.Context, log logr.Logger, cr *matrixv1alpha1.Synapse, obj object) (bool, error) {
+	kind := reflect.TypeOf(obj).Elem().Name()
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}, obj)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.IsNotFound(err) {
+		log.Error(err, "get "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonGetFailed,
+			"get %s %s: %v", kind, obj.GetName(), err)
+		return false, err
+	}
+
+	ctrl.SetControllerReference(cr, obj, r.Scheme)
+	log.Info("creating "+kind,
+		kind+".Namespace", obj.GetNamespace(),
+		kind+".Name", obj.GetName())
+	err = r.Create(ctx, obj)
 	if err != nil {
-		// Signing key generation fails iff the system RNG is broken.
-		// We can accept a panic in that case.
-		panic(err)
+		log.Error(err, "create "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonCreateFailed,
+			"create %s %s: %v", kind, obj.GetName(), err)
+		return false, err
 	}
-	return &v1.Secret{
+	r.Recorder.Eventf(cr, v1.EventTypeNormal, kind+"Created",
+		"Created %s %s", kind, obj.GetName())
+	return true, nil
+}
+
+// CreateSecretIfNotExists creates the Secret returned by generate unless one
+// with the given name exists already. Unlike createIfNotExists, it doesn't
+// generate values only to throw them away. It returns the Secret found or
+// created and whether it was created.
+func (r *SynapseReconciler) createSecretIfNotExists(ctx context.Context, log logr.Logger, cr *matrixv1alpha1.Synapse, name string, generate func(*matrixv1alpha1.Synapse) (*v1.Secret, error)) (*v1.Secret, bool, error) {
+	secret := &v1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      name,
+		Namespace: cr.Namespace,
+	}, secret)
+	if err == nil {
+		return secret, false, nil
+	}
+	if !errors.IsNotFound(err) {
+		log.Error(err, "get Secret",
+			"Secret.Namespace", cr.Namespace,
+			"Secret.Name", name)
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonGetFailed,
+			"get Secret %s: %v", name, err)
+		return nil, false, err
+	}
+
+	secret, err = generate(cr)
+	if err != nil {
+		log.Error(err, "generate Secret",
+			"Secret.Namespace", cr.Namespace,
+			"Secret.Name", name)
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonSecretGenerationFailed,
+			"generate Secret %s: %v", name, err)
+		return nil, false, err
+	}
+	created, err := r.createIfNotExists(ctx, log, cr, secret)
+	return secret, created, err
+}
+
+// DeleteIfControlled deletes obj if it exists and is controlled by cr. It
+// reports whether obj was deleted.
+func (r *SynapseReconciler) deleteIfControlled(ctx context.Context, log logr.Logger, cr *matrixv1alpha1.Synapse, obj object, opts ...client.DeleteOption) (bool, error) {
+	kind := reflect.TypeOf(obj).Elem().Name()
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}, obj)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		log.Error(err, "get "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonGetFailed,
+			"get %s %s: %v", kind, obj.GetName(), err)
+		return false, err
+	}
+	if !metav1.IsControlledBy(obj, cr) {
+		return false, nil
+	}
+
+	log.Info("deleting "+kind,
+		kind+".Namespace", obj.GetNamespace(),
+		kind+".Name", obj.GetName())
+	err = r.Delete(ctx, obj, opts...)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error(err, "delete "+kind,
+			kind+".Namespace", obj.GetNamespace(),
+			kind+".Name", obj.GetName())
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonDeleteFailed,
+			"delete %s %s: %v", kind, obj.GetName(), err)
+		return false, err
+	}
+	r.Recorder.Eventf(cr, v1.EventTypeNormal, kind+"Deleted",
+		"Deleted %s %s", kind, obj.GetName())
+	return true, nil
+}
+
+// SynapseSecret returns a Secret holding the signing key and the secrets
+// Synapse needs. Values found in imported are used as is, the others are
+// generated.
+func synapseSecret(cr *matrixv1alpha1.Synapse, imported map[string][]byte) (*v1.Secret, error) {
+	data := make(map[string][]byte)
+	for k, v := range imported {
+		data[k] = v
+	}
+	if _, ok := data[signingKeySecretKey]; !ok {
+		signingKey, err := newSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		data[signingKeySecretKey] = signingKey
+	}
+	for _, key := range generatedSecretKeys {
+		if _, ok := data[key]; ok {
+			continue
+		}
+		value, err := randomString(64)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = []byte(value)
+	}
+
+	secret := &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name,
 			Namespace: cr.Namespace,
 			Labels:    synapseLabels(cr.Name),
 		},
-		Data: map[string][]byte{
-			"signing-key":                signingKey,
-			"registration-shared-secret": []byte(randomString(64)),
-			"macaroon-secret-key":        []byte(randomString(64)),
-			"form-secret":                []byte(randomString(64)),
-		},
+		Data: data,
 		Type: "Opaque",
 	}
+	// Fresh values need no rotation.
+	secret.Annotations = rotationAnnotations(cr)
+	return secret, nil
 }
 
 const inputIDAnnotationKey = "matrix.slrz.net/input-identifier"
 
-func synapseConfigMap(cr *matrixv1alpha1.Synapse, secret *v1.Secret) *v1.ConfigMap {
-	// When attached to the config map, the digest allows us to detect when
-	// the generated config file has become stale in relation to the inputs
-	// it was generated from.
-	config, dgst := homeserverConfigFromCR(cr, secret)
-
-	yamlBytes, err := synapseconf.GenerateHomeserverYAML(config)
-	if err != nil {
-		// BUG(ls): Properly return an error instead of panicking.
-		// Unlikely to be an issue until we support user-provided
-		// templates for homeserver.yaml but still.
-		panic(err)
-	}
-
+// SynapseConfigMap returns the ConfigMap holding homeserver.yaml and the
+// log config. Dgst identifies the inputs homeserver.yaml was generated from.
+func synapseConfigMap(cr *matrixv1alpha1.Synapse, homeserverYAML []byte, dgst string) *v1.ConfigMap {
 	return &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name,
@@ -257,45 +994,63 @@ func synapseConfigMap(cr *matrixv1alpha1.Synapse, secret *v1.Secret) *v1.ConfigM
 			},
 		},
 		Data: map[string]string{
-			"homeserver.yaml":       string(yamlBytes),
+			"homeserver.yaml":       string(homeserverYAML),
 			"homeserver.log.config": synapseLogConfig(),
 		},
 	}
 }
 
-const synapseDefaultImage = "docker.io/matrixdotorg/synapse:latest"
+// The pod template annotation recording the config the pods were started
+// with. Synapse doesn't reload its config, so we have to replace the pods
+// whenever it changes.
+const podConfigAnnotationKey = "matrix.slrz.net/config-digest"
+
+// PodConfigDigest computes a digest over the homeserver.yaml digest
+// recorded on cm and the contents of secret (which also holds the signing
+// key).
+func podConfigDigest(secret *v1.Secret, cm *v1.ConfigMap) string {
+	return configDigest([]byte(cm.Annotations[inputIDAnnotationKey]), secret)
+}
 
 func synapseDeployment(cr *matrixv1alpha1.Synapse, secret *v1.Secret, cm *v1.ConfigMap) *appsv1.Deployment {
 	ls := synapseLabels(cr.Name)
 	replicas := int32(1)
-	image := synapseDefaultImage
+	image := matrixv1alpha1.DefaultImage
 	if cr.Spec.Image != "" {
 		image = cr.Spec.Image
 	}
 
 	return &appsv1.Deployment{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name,
 			Namespace: cr.Namespace,
+			Labels:    ls,
 		},
 		Spec: appsv1.DeploymentSpec{
+			// Synapse's main process can't be scaled horizontally.
 			Replicas: &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: ls,
 			},
+			Strategy: synapseDeploymentStrategy(cr),
 			Template: v1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: ls,
+					Annotations: map[string]string{
+						podConfigAnnotationKey: podConfigDigest(secret, cm),
+					},
 				},
 				Spec: v1.PodSpec{
-					Volumes: synapseVolumes(secret, cm),
+					Volumes: synapseVolumes(cr, secret, cm),
 					Containers: []v1.Container{{
-						Image: image,
-						Name:  "synapse",
-						Ports: []v1.ContainerPort{{
-							ContainerPort: 8008,
-							Name:          "http",
-						}},
+						Image:        image,
+						Name:         "synapse",
+						Ports:        synapseContainerPorts(cr),
 						VolumeMounts: synapseVolumeMounts(cr),
 					}},
 				},
@@ -304,41 +1059,85 @@ func synapseDeployment(cr *matrixv1alpha1.Synapse, secret *v1.Secret, cm *v1.Con
 	}
 }
 
-// ReconcileSynapseDeployment returns the desired Deployment state and a
-// boolean indicating whether it differs from the current state.
-func reconcileSynapseDeployment(cr *matrixv1alpha1.Synapse, current *appsv1.Deployment) (*appsv1.Deployment, bool) {
-	image := synapseDefaultImage
-	if cr.Spec.Image != "" {
-		image = cr.Spec.Image
+// SynapseContainerPorts returns the ports of the main Synapse container.
+func synapseContainerPorts(cr *matrixv1alpha1.Synapse) []v1.ContainerPort {
+	ports := []v1.ContainerPort{{
+		ContainerPort: synapseHTTPPort,
+		Name:          "http",
+	}}
+	if hasWorkers(cr) {
+		ports = append(ports, v1.ContainerPort{
+			ContainerPort: synapseconf.ReplicationHTTPPort,
+			Name:          "replication",
+		})
 	}
+	return ports
+}
+
+// SynapseDeploymentStrategy returns the update strategy for the Synapse
+// Deployment. A persistent data volume can't be shared between the old and
+// new pod during a rolling update, so we have to recreate instead.
+func synapseDeploymentStrategy(cr *matrixv1alpha1.Synapse) appsv1.DeploymentStrategy {
+	return deploymentStrategy(dataClaimName(cr) != "")
+}
 
-	containers := current.Spec.Template.Spec.Containers
-	if len(containers) > 0 && containers[0].Image == image {
-		return current, false
+// DeploymentStrategy returns the Recreate strategy if recreate is set and a
+// RollingUpdate strategy otherwise.
+func deploymentStrategy(recreate bool) appsv1.DeploymentStrategy {
+	if recreate {
+		return appsv1.DeploymentStrategy{
+			Type: appsv1.RecreateDeploymentStrategyType,
+		}
+	}
+	// Spell out the defaults so that they're owned by us and get
+	// removed when switching to Recreate.
+	maxUnavailable := intstr.FromString("25%")
+	maxSurge := intstr.FromString("25%")
+	return appsv1.DeploymentStrategy{
+		Type: appsv1.RollingUpdateDeploymentStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateDeployment{
+			MaxUnavailable: &maxUnavailable,
+			MaxSurge:       &maxSurge,
+		},
 	}
+}
 
-	// Update deployment in response to CR change
-	next := current.DeepCopy()
-	next.Spec.Template.Spec.Containers = []v1.Container{{
-		Image: image,
-		Name:  "synapse",
-		Ports: []v1.ContainerPort{{
-			ContainerPort: 8008,
-			Name:          "http",
-		}},
-		VolumeMounts: synapseVolumeMounts(cr),
-	}}
+// PrepareDeploymentStrategy clears the rolling update parameters of an
+// existing Deployment about to be switched to the Recreate strategy. The
+// API server rejects them in combination with Recreate, but server-side
+// apply won't remove them if they are owned by another field manager, as is
+// the case for Deployments created before we used server-side apply.
+func (r *SynapseReconciler) prepareDeploymentStrategy(ctx context.Context, cr *matrixv1alpha1.Synapse, dep *appsv1.Deployment) error {
+	want := synapseDeploymentStrategy(cr)
+	if want.Type != appsv1.RecreateDeploymentStrategyType || dep.Spec.Strategy.RollingUpdate == nil {
+		return nil
+	}
 
-	return next, true
+	patch := client.MergeFrom(dep.DeepCopy())
+	dep.Spec.Strategy = want
+	return r.Patch(ctx, dep, patch)
 }
 
-func synapseVolumes(secret *v1.Secret, cm *v1.ConfigMap) []v1.Volume {
-	return []v1.Volume{
-		{
-			Name: "data",
-			VolumeSource: v1.VolumeSource{
-				EmptyDir: &v1.EmptyDirVolumeSource{},
+// DataVolumeSource returns the volume source for Synapse's data directory:
+// the persistent volume claim if one is configured, an EmptyDir otherwise.
+func dataVolumeSource(cr *matrixv1alpha1.Synapse) v1.VolumeSource {
+	if claimName := dataClaimName(cr); claimName != "" {
+		return v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
 			},
+		}
+	}
+	return v1.VolumeSource{
+		EmptyDir: &v1.EmptyDirVolumeSource{},
+	}
+}
+
+func synapseVolumes(cr *matrixv1alpha1.Synapse, secret *v1.Secret, cm *v1.ConfigMap) []v1.Volume {
+	volumes := []v1.Volume{
+		{
+			Name:         "data",
+			VolumeSource: dataVolumeSource(cr),
 		},
 		{
 			Name: "secrets",
@@ -359,6 +1158,7 @@ func synapseVolumes(secret *v1.Secret, cm *v1.ConfigMap) []v1.Volume {
 			},
 		},
 	}
+	return append(volumes, mediaVolumes(cr)...)
 }
 
 func synapseVolumeMounts(cr *matrixv1alpha1.Synapse) []v1.VolumeMount {
@@ -368,7 +1168,7 @@ func synapseVolumeMounts(cr *matrixv1alpha1.Synapse) []v1.VolumeMount {
 		logConfigFilename      = "homeserver.log.config"
 	)
 
-	return []v1.VolumeMount{
+	mounts := []v1.VolumeMount{
 		{
 			Name:      "data",
 			MountPath: "/data",
@@ -392,54 +1192,101 @@ func synapseVolumeMounts(cr *matrixv1alpha1.Synapse) []v1.VolumeMount {
 			ReadOnly:  true,
 		},
 	}
+	return append(mounts, mediaVolumeMounts(cr)...)
 }
 
 func synapseLabels(name string) map[string]string {
 	return map[string]string{"app": "synapse", "synapse_cr": name}
 }
 
-func homeserverConfigFromCR(cr *matrixv1alpha1.Synapse, secret *v1.Secret) (c *synapseconf.HomeserverConfig, id string) {
+func homeserverConfigFromCR(cr *matrixv1alpha1.Synapse, secret *v1.Secret, refs *resolvedRefs) *synapseconf.HomeserverConfig {
 	config := &synapseconf.HomeserverConfig{
-		ServerName:  cr.Spec.ServerName,
-		ReportStats: cr.Spec.ReportStats,
+		ServerName:    cr.Spec.ServerName,
+		PublicBaseURL: publicBaseURL(cr),
+		ReportStats:   cr.Spec.ReportStats,
+
+		RegistrationSharedSecret: string(secret.Data[registrationSharedSecretKey]),
+		MacaroonSecretKey:        string(secret.Data[macaroonSecretKeyKey]),
+		FormSecret:               string(secret.Data[formSecretKey]),
+
+		PostgresConfig: refs.postgres,
+		RedisConfig:    refs.redis,
+		EmailConfig:    refs.email,
+		TurnConfig:     refs.turn,
+
+		S3StorageConfig: refs.s3Storage,
+		MediaConfig:     mediaConfig(cr),
 
-		RegistrationSharedSecret: string(secret.Data["registration-shared-secret"]),
-		MacaroonSecretKey:        string(secret.Data["macaroon-secret-key"]),
-		FormSecret:               string(secret.Data["form-secret"]),
+		RegistrationConfig: refs.registration,
+		OIDCProviders:      refs.oidc,
+
+		ExtraConfigYAML: refs.extraConfig,
+		OldSigningKeys:  refs.oldSigningKeys,
+
+		FederationSenderInstances: workerInstances(cr, matrixv1alpha1.WorkerFederationSender),
+		PusherInstances:           workerInstances(cr, matrixv1alpha1.WorkerPusher),
+		DisableMediaRepo:          hasWorker(cr, matrixv1alpha1.WorkerMedia),
+	}
+	if hasWorkers(cr) {
+		config.ReplicationHost = replicationServiceName(cr)
+	}
+	if names := workerInstances(cr, matrixv1alpha1.WorkerAppservice); len(names) > 0 {
+		config.AppserviceWorker = names[0]
+	}
+	return config
+}
+
+// HomeserverYAML generates homeserver.yaml from config, using the
+// user-supplied template if the CR refers to one.
+func (r *SynapseReconciler) homeserverYAML(ctx context.Context, cr *matrixv1alpha1.Synapse, config *synapseconf.HomeserverConfig, refs *resolvedRefs) ([]byte, error) {
+	if refs.configTemplate == "" {
+		cr.Status.TemplateSecrets = nil
+		return synapseconf.GenerateHomeserverYAML(config)
+	}
+	// Record the Secrets read by the template, even if rendering fails,
+	// so that changes to them trigger a reconcile.
+	read := make(map[string]bool)
+	secret := func(name, key string) (string, error) {
+		read[name] = true
+		return r.secretKeyValue(ctx, cr.Namespace, &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: name},
+			Key:                  key,
+		})
+	}
+	p, err := synapseconf.GenerateHomeserverYAMLFromTemplate(refs.configTemplate, config, secret)
+	names := make([]string, 0, len(read))
+	for name := range read {
+		names = append(names, name)
 	}
-	// Compute a digest over the inputs of homeserver.yaml generation.
-	// Input variations change the digest and we can re-generate the
-	// config.
+	sort.Strings(names)
+	if len(names) == 0 {
+		names = nil
+	}
+	cr.Status.TemplateSecrets = names
+	return p, err
+}
+
+// ConfigDigest returns a digest over the generated homeserver.yaml and the
+// data of the Synapse Secret, which together determine the configuration
+// Synapse runs with.
+func configDigest(config []byte, secret *v1.Secret) string {
 	h := sha256.New()
+	h.Write(config)
+	h.Write([]byte{0})
 
-	t := reflect.TypeOf(config).Elem()
-	v := reflect.ValueOf(config).Elem()
-	for i := 0; i < t.NumField(); i++ {
-		h.Write([]byte(t.Field(i).Name))
-		switch fieldValue := v.Field(i).Interface().(type) {
-		case string:
-			h.Write([]byte(fieldValue))
-		case []byte:
-			h.Write(fieldValue)
-		case bool:
-			var b [1]byte
-			if fieldValue {
-				b[0] = 1
-			}
-			h.Write(b[:])
-		case *synapseconf.PostgresConfig:
-			if fieldValue != nil {
-				h.Write([]byte(fieldValue.User))
-				h.Write([]byte(fieldValue.Password))
-				h.Write([]byte(fieldValue.Database))
-				h.Write([]byte(fieldValue.Host))
-				h.Write([]byte(fieldValue.Port))
-			}
-		}
+	keys := make([]string, 0, len(secret.Data))
+	for k := range secret.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(secret.Data[k])
+		h.Write([]byte{0})
 	}
 
-	id = hex.EncodeToString(h.Sum(nil))
-	return config, id
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // SynapseLogConfig just returns a static string for now.
@@ -475,13 +1322,17 @@ disable_existing_loggers: false
 `
 }
 
+// RandReader is the source of randomness for generated secrets. Tests
+// replace it to simulate RNG failures.
+var randReader io.Reader = rand.Reader
+
 // RandomString generates a printable random string of length n using a
 // cryptographically-secure RNG.
-func randomString(n int) string {
+func randomString(n int) (string, error) {
 	scratch := make([]byte, (n+3)/4*3)
-	if _, err := rand.Read(scratch); err != nil {
-		panic(err)
+	if _, err := io.ReadFull(randReader, scratch); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
 	}
 
-	return base64.URLEncoding.EncodeToString(scratch)[:n]
+	return base64.URLEncoding.EncodeToString(scratch)[:n], nil
 }
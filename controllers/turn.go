@@ -0,0 +1,307 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+const coturnPort = synapseconf.DefaultCoturnListeningPort
+
+// ManagesCoturn reports whether the CR asks for an operator-managed coturn
+// server.
+func managesCoturn(cr *matrixv1alpha1.Synapse) bool {
+	return cr.Spec.Turn != nil && cr.Spec.Turn.Managed
+}
+
+// ManagedCoturnName returns the name shared by the Secret, ConfigMap,
+// Service and Deployment making up the managed coturn server.
+func managedCoturnName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-coturn"
+}
+
+func coturnLabels(name string) map[string]string {
+	return map[string]string{"app": "synapse-coturn", "synapse_cr": name}
+}
+
+// CoturnRelayPorts returns the range of UDP ports the managed coturn server
+// relays media on.
+func coturnRelayPorts(cr *matrixv1alpha1.Synapse) (min, max int32) {
+	min, max = matrixv1alpha1.DefaultMinRelayPort, matrixv1alpha1.DefaultMaxRelayPort
+	if mc := cr.Spec.Turn.ManagedCoturn; mc != nil {
+		if mc.MinRelayPort != 0 {
+			min = mc.MinRelayPort
+		}
+		if mc.MaxRelayPort != 0 {
+			max = mc.MaxRelayPort
+		}
+	}
+	return min, max
+}
+
+// ValidateCoturn checks the managed coturn settings the webhook may not
+// have seen.
+func validateCoturn(cr *matrixv1alpha1.Synapse) error {
+	min, max := coturnRelayPorts(cr)
+	if min > max {
+		return invalidSpecf("turn.managedCoturn: relay port range %d-%d is empty", min, max)
+	}
+	if max-min+1 > matrixv1alpha1.MaxRelayPorts {
+		return invalidSpecf("turn.managedCoturn: relay port range %d-%d holds more than %d ports",
+			min, max, matrixv1alpha1.MaxRelayPorts)
+	}
+	return nil
+}
+
+func synapseCoturnSecret(cr *matrixv1alpha1.Synapse) (*v1.Secret, error) {
+	secret, err := randomString(64)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedCoturnName(cr),
+			Namespace: cr.Namespace,
+			Labels:    coturnLabels(cr.Name),
+		},
+		Data: map[string][]byte{
+			"shared-secret": []byte(secret),
+		},
+		Type: "Opaque",
+	}, nil
+}
+
+// ManagedCoturnSecretKeyRef selects the secret shared between Synapse and
+// the managed coturn server.
+func managedCoturnSecretKeyRef(cr *matrixv1alpha1.Synapse) *v1.SecretKeySelector {
+	return &v1.SecretKeySelector{
+		LocalObjectReference: v1.LocalObjectReference{
+			Name: managedCoturnName(cr),
+		},
+		Key: "shared-secret",
+	}
+}
+
+// SynapseCoturnService returns the LoadBalancer Service exposing the managed
+// coturn server. Every relay port needs its own Service port.
+func synapseCoturnService(cr *matrixv1alpha1.Synapse) *v1.Service {
+	ports := []v1.ServicePort{{
+		Name:       "turn",
+		Protocol:   v1.ProtocolUDP,
+		Port:       coturnPort,
+		TargetPort: intstr.FromInt(coturnPort),
+	}}
+	min, max := coturnRelayPorts(cr)
+	for p := min; p <= max; p++ {
+		ports = append(ports, v1.ServicePort{
+			Name:       "relay-" + strconv.Itoa(int(p)),
+			Protocol:   v1.ProtocolUDP,
+			Port:       p,
+			TargetPort: intstr.FromInt(int(p)),
+		})
+	}
+
+	return &v1.Service{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedCoturnName(cr),
+			Namespace: cr.Namespace,
+			Labels:    coturnLabels(cr.Name),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeLoadBalancer,
+			Selector: coturnLabels(cr.Name),
+			Ports:    ports,
+		},
+	}
+}
+
+// CoturnAddress returns the address clients reach the managed coturn server
+// at: the one given in the spec or else the one assigned to svc by the
+// load balancer. It returns the empty string if there's none yet.
+func coturnAddress(cr *matrixv1alpha1.Synapse, svc *v1.Service) string {
+	if mc := cr.Spec.Turn.ManagedCoturn; mc != nil && mc.ExternalAddress != "" {
+		return mc.ExternalAddress
+	}
+	for _, ing := range svc.Status.LoadBalancer.Ingress {
+		if ing.IP != "" {
+			return ing.IP
+		}
+		if ing.Hostname != "" {
+			return ing.Hostname
+		}
+	}
+	return ""
+}
+
+// ManagedTurnURIs returns the URIs handed out to clients for reaching the
+// managed coturn server at address.
+func managedTurnURIs(address string) []string {
+	hostport := net.JoinHostPort(address, strconv.Itoa(coturnPort))
+	return []string{"turn:" + hostport + "?transport=udp"}
+}
+
+// SynapseCoturnConfigMap returns the ConfigMap holding turnserver.conf.
+func synapseCoturnConfigMap(cr *matrixv1alpha1.Synapse) (*v1.ConfigMap, error) {
+	min, max := coturnRelayPorts(cr)
+	conf, err := synapseconf.GenerateCoturnConfig(&synapseconf.CoturnConfig{
+		Realm:        cr.Spec.ServerName,
+		MinRelayPort: int(min),
+		MaxRelayPort: int(max),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.ConfigMap{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedCoturnName(cr),
+			Namespace: cr.Namespace,
+			Labels:    coturnLabels(cr.Name),
+		},
+		Data: map[string]string{
+			"turnserver.conf": string(conf),
+		},
+	}, nil
+}
+
+// CoturnConfigDigest computes a digest over turnserver.conf and the shared
+// secret, neither of which coturn reloads.
+func coturnConfigDigest(cm *v1.ConfigMap, secret *v1.Secret) string {
+	h := sha256.New()
+	h.Write([]byte(cm.Data["turnserver.conf"]))
+	h.Write([]byte{0})
+	h.Write(secret.Data["shared-secret"])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SynapseCoturnDeployment returns the Deployment running the managed coturn
+// server. If address is an IP address, coturn is told it's behind NAT so
+// the relay addresses it hands out are reachable from outside.
+func synapseCoturnDeployment(cr *matrixv1alpha1.Synapse, secret *v1.Secret, cm *v1.ConfigMap, address string) *appsv1.Deployment {
+	ls := coturnLabels(cr.Name)
+	replicas := int32(1)
+	image := matrixv1alpha1.DefaultCoturnImage
+	if mc := cr.Spec.Turn.ManagedCoturn; mc != nil && mc.Image != "" {
+		image = mc.Image
+	}
+
+	args := []string{
+		"-c", "/etc/coturn/turnserver.conf",
+		"--static-auth-secret=$(TURN_SHARED_SECRET)",
+	}
+	if net.ParseIP(address) != nil {
+		args = append(args, fmt.Sprintf("--external-ip=%s/$(POD_IP)", address))
+	}
+
+	ports := []v1.ContainerPort{{
+		ContainerPort: coturnPort,
+		Name:          "turn",
+		Protocol:      v1.ProtocolUDP,
+	}}
+	min, max := coturnRelayPorts(cr)
+	for p := min; p <= max; p++ {
+		ports = append(ports, v1.ContainerPort{
+			ContainerPort: p,
+			Protocol:      v1.ProtocolUDP,
+		})
+	}
+
+	return &appsv1.Deployment{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedCoturnName(cr),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ls,
+					Annotations: map[string]string{
+						podConfigAnnotationKey: coturnConfigDigest(cm, secret),
+					},
+				},
+				Spec: v1.PodSpec{
+					Volumes: []v1.Volume{{
+						Name: "config",
+						VolumeSource: v1.VolumeSource{
+							ConfigMap: &v1.ConfigMapVolumeSource{
+								LocalObjectReference: v1.LocalObjectReference{
+									Name: cm.Name,
+								},
+							},
+						},
+					}},
+					Containers: []v1.Container{{
+						Image: image,
+						Name:  "coturn",
+						Args:  args,
+						Env: []v1.EnvVar{{
+							Name: "TURN_SHARED_SECRET",
+							ValueFrom: &v1.EnvVarSource{
+								SecretKeyRef: managedCoturnSecretKeyRef(cr),
+							},
+						}, {
+							Name: "POD_IP",
+							ValueFrom: &v1.EnvVarSource{
+								FieldRef: &v1.ObjectFieldSelector{
+									FieldPath: "status.podIP",
+								},
+							},
+						}},
+						Ports: ports,
+						VolumeMounts: []v1.VolumeMount{{
+							Name:      "config",
+							MountPath: "/etc/coturn",
+							ReadOnly:  true,
+						}},
+					}},
+				},
+			},
+		},
+	}
+}
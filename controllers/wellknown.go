@@ -0,0 +1,327 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+)
+
+const (
+	wellKnownImage = "docker.io/nginxinc/nginx-unprivileged:stable-alpine"
+	wellKnownPort  = 8080
+)
+
+// WellKnownNginxConfig serves the files below /.well-known/matrix with the
+// headers the Matrix spec asks for.
+const wellKnownNginxConfig = `server {
+    listen 8080;
+
+    location /.well-known/matrix/ {
+        root /usr/share/nginx/html;
+        default_type application/json;
+        add_header Access-Control-Allow-Origin *;
+    }
+}
+`
+
+// DelegatesServerName reports whether the CR asks for .well-known
+// delegation.
+func delegatesServerName(cr *matrixv1alpha1.Synapse) bool {
+	return cr.Spec.Delegation != nil
+}
+
+// WellKnownName returns the name shared by the objects serving the
+// .well-known documents.
+func wellKnownName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-well-known"
+}
+
+func wellKnownLabels(name string) map[string]string {
+	return map[string]string{"app": "synapse-well-known", "synapse_cr": name}
+}
+
+// PublicBaseURL returns the URL clients use to reach Synapse or the empty
+// string to go with the default derived from the server name.
+func publicBaseURL(cr *matrixv1alpha1.Synapse) string {
+	if d := cr.Spec.Delegation; d != nil {
+		return d.PublicBaseURL
+	}
+	return ""
+}
+
+// ServerNameHost returns the host part of the CR's server name.
+func serverNameHost(cr *matrixv1alpha1.Synapse) string {
+	if host, _, err := net.SplitHostPort(cr.Spec.ServerName); err == nil {
+		return host
+	}
+	return cr.Spec.ServerName
+}
+
+func validateDelegation(cr *matrixv1alpha1.Synapse) error {
+	d := cr.Spec.Delegation
+	if d.PublicBaseURL != "" {
+		u, err := url.Parse(d.PublicBaseURL)
+		if err != nil {
+			return invalidSpecf("delegation.publicBaseURL: %v", err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return invalidSpecf("delegation.publicBaseURL: need absolute http(s) URL, got %q", d.PublicBaseURL)
+		}
+	}
+	if d.FederationHost == "" && d.FederationPort != 0 {
+		return invalidSpecf("delegation.federationPort requires delegation.federationHost")
+	}
+	if d.PublicBaseURL == "" && d.FederationHost == "" {
+		return invalidSpecf("delegation needs publicBaseURL or federationHost")
+	}
+	return nil
+}
+
+// WellKnownDocuments renders the contents of /.well-known/matrix/server
+// and /.well-known/matrix/client. Documents not applicable to the CR are
+// omitted from the returned map.
+func wellKnownDocuments(cr *matrixv1alpha1.Synapse) (map[string]string, error) {
+	d := cr.Spec.Delegation
+	docs := make(map[string]string)
+
+	if d.FederationHost != "" {
+		port := d.FederationPort
+		if port == 0 {
+			port = matrixv1alpha1.DefaultFederationPort
+		}
+		p, err := json.Marshal(map[string]string{
+			"m.server": net.JoinHostPort(d.FederationHost, strconv.Itoa(int(port))),
+		})
+		if err != nil {
+			return nil, err
+		}
+		docs["server"] = string(p)
+	}
+	if d.PublicBaseURL != "" {
+		p, err := json.Marshal(map[string]interface{}{
+			"m.homeserver": map[string]string{
+				"base_url": d.PublicBaseURL,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		docs["client"] = string(p)
+	}
+
+	return docs, nil
+}
+
+func wellKnownConfigMap(cr *matrixv1alpha1.Synapse, docs map[string]string) *v1.ConfigMap {
+	data := map[string]string{
+		"default.conf": wellKnownNginxConfig,
+	}
+	for k, v := range docs {
+		data[k] = v
+	}
+	return &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      wellKnownName(cr),
+			Namespace: cr.Namespace,
+			Labels:    wellKnownLabels(cr.Name),
+		},
+		Data: data,
+	}
+}
+
+// WellKnownDeployment returns the nginx Deployment serving the delegation
+// documents. Only those are projected below /.well-known/matrix so the nginx
+// config sharing their ConfigMap isn't served along with them. They are
+// optional as either may be missing, depending on the spec.
+func wellKnownDeployment(cr *matrixv1alpha1.Synapse) *appsv1.Deployment {
+	ls := wellKnownLabels(cr.Name)
+	replicas := int32(1)
+	optional := true
+
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      wellKnownName(cr),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ls,
+				},
+				Spec: v1.PodSpec{
+					Volumes: []v1.Volume{{
+						Name: "config",
+						VolumeSource: v1.VolumeSource{
+							ConfigMap: &v1.ConfigMapVolumeSource{
+								LocalObjectReference: v1.LocalObjectReference{
+									Name: wellKnownName(cr),
+								},
+								Items: []v1.KeyToPath{{
+									Key:  "default.conf",
+									Path: "default.conf",
+								}},
+							},
+						},
+					}, {
+						Name: "documents",
+						VolumeSource: v1.VolumeSource{
+							ConfigMap: &v1.ConfigMapVolumeSource{
+								LocalObjectReference: v1.LocalObjectReference{
+									Name: wellKnownName(cr),
+								},
+								Items: []v1.KeyToPath{
+									{Key: "client", Path: "client"},
+									{Key: "server", Path: "server"},
+								},
+								Optional: &optional,
+							},
+						},
+					}},
+					Containers: []v1.Container{{
+						Image: wellKnownImage,
+						Name:  "nginx",
+						Ports: []v1.ContainerPort{{
+							ContainerPort: wellKnownPort,
+							Name:          "http",
+						}},
+						VolumeMounts: []v1.VolumeMount{
+							{
+								Name:      "config",
+								MountPath: "/etc/nginx/conf.d/default.conf",
+								SubPath:   "default.conf",
+								ReadOnly:  true,
+							},
+							// Not using subPath here so that
+							// updates become visible without a
+							// restart.
+							{
+								Name:      "documents",
+								MountPath: "/usr/share/nginx/html/.well-known/matrix",
+								ReadOnly:  true,
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func wellKnownService(cr *matrixv1alpha1.Synapse) *v1.Service {
+	return &v1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      wellKnownName(cr),
+			Namespace: cr.Namespace,
+			Labels:    wellKnownLabels(cr.Name),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeClusterIP,
+			Selector: wellKnownLabels(cr.Name),
+			Ports: []v1.ServicePort{{
+				Name:       "http",
+				Protocol:   v1.ProtocolTCP,
+				Port:       80,
+				TargetPort: intstr.FromString("http"),
+			}},
+		},
+	}
+}
+
+// WellKnownIngress routes /.well-known/matrix on the server name to the
+// .well-known Service. Ingress class and annotations are shared with the
+// Synapse Ingress.
+func wellKnownIngress(cr *matrixv1alpha1.Synapse) *networkingv1beta1.Ingress {
+	pathType := networkingv1beta1.PathTypePrefix
+	host := serverNameHost(cr)
+
+	var (
+		ingressClassName *string
+		annotations      map[string]string
+	)
+	if ex := cr.Spec.Expose; ex != nil {
+		ingressClassName = ex.IngressClassName
+		annotations = ex.IngressAnnotations
+	}
+
+	var tls []networkingv1beta1.IngressTLS
+	if s := cr.Spec.Delegation.TLSSecretName; s != "" {
+		tls = []networkingv1beta1.IngressTLS{{
+			Hosts:      []string{host},
+			SecretName: s,
+		}}
+	}
+
+	return &networkingv1beta1.Ingress{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1beta1.SchemeGroupVersion.String(),
+			Kind:       "Ingress",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        wellKnownName(cr),
+			Namespace:   cr.Namespace,
+			Labels:      wellKnownLabels(cr.Name),
+			Annotations: annotations,
+		},
+		Spec: networkingv1beta1.IngressSpec{
+			IngressClassName: ingressClassName,
+			TLS:              tls,
+			Rules: []networkingv1beta1.IngressRule{{
+				Host: host,
+				IngressRuleValue: networkingv1beta1.IngressRuleValue{
+					HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+						Paths: []networkingv1beta1.HTTPIngressPath{{
+							Path:     "/.well-known/matrix",
+							PathType: &pathType,
+							Backend: networkingv1beta1.IngressBackend{
+								ServiceName: wellKnownName(cr),
+								ServicePort: intstr.FromString("http"),
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+}
@@ -0,0 +1,552 @@
+/*
+Copyright © 2020 The synapse-operator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	matrixv1alpha1 "github.com/slrz/synapse-operator/api/v1alpha1"
+	"github.com/slrz/synapse-operator/pkg/synapseconf"
+)
+
+// Workers of all types run the generic worker application. The main
+// process' config decides which tasks they take over.
+const workerApp = "synapse.app.generic_worker"
+
+// WorkerResources lists the resources served on the HTTP listener of each
+// worker type. Types without resources get no listener.
+var workerResources = map[matrixv1alpha1.SynapseWorkerType][]string{
+	matrixv1alpha1.WorkerGeneric:          {"client", "federation"},
+	matrixv1alpha1.WorkerFederationSender: nil,
+	matrixv1alpha1.WorkerMedia:            {"media"},
+	matrixv1alpha1.WorkerPusher:           nil,
+	matrixv1alpha1.WorkerAppservice:       nil,
+}
+
+// The directory workers read their configuration from. It's populated by
+// an init container as the worker name has to differ between replicas.
+const workerConfigDir = "/config"
+
+// HasWorkers reports whether the CR asks for any worker processes.
+func hasWorkers(cr *matrixv1alpha1.Synapse) bool {
+	return len(cr.Spec.Workers) > 0
+}
+
+// HasWorker reports whether the CR asks for workers of type typ.
+func hasWorker(cr *matrixv1alpha1.Synapse, typ matrixv1alpha1.SynapseWorkerType) bool {
+	for _, w := range cr.Spec.Workers {
+		if w.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWorkers(cr *matrixv1alpha1.Synapse) error {
+	if hasWorkers(cr) && !cr.Spec.Redis.Enabled() {
+		return invalidSpecf("workers need redis for replication")
+	}
+	seen := make(map[matrixv1alpha1.SynapseWorkerType]bool)
+	for _, w := range cr.Spec.Workers {
+		if _, ok := workerResources[w.Type]; !ok {
+			return invalidSpecf("workers: unknown worker type %q", w.Type)
+		}
+		if seen[w.Type] {
+			return invalidSpecf("workers: duplicate worker type %q", w.Type)
+		}
+		seen[w.Type] = true
+		if w.Type.Singleton() && w.Replicas != nil && *w.Replicas > 1 {
+			return invalidSpecf("workers: %s workers can't have more than one replica", w.Type)
+		}
+	}
+	return nil
+}
+
+// ReplicationServiceName returns the name of the Service through which
+// workers reach the HTTP replication listener of the main process.
+func replicationServiceName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-replication"
+}
+
+// WorkersConfigMapName returns the name of the ConfigMap holding the worker
+// config files.
+func workersConfigMapName(cr *matrixv1alpha1.Synapse) string {
+	return cr.Name + "-workers"
+}
+
+// WorkerName returns the name of the Deployment and Service for workers of
+// type typ.
+func workerName(cr *matrixv1alpha1.Synapse, typ matrixv1alpha1.SynapseWorkerType) string {
+	return cr.Name + "-worker-" + strings.ReplaceAll(string(typ), "_", "-")
+}
+
+// WorkerInstances returns the worker_name of the workers of type typ, by
+// which the main process' config hands tasks to them. Only singleton types
+// are listed there, so their name is fixed instead of the pod name.
+func workerInstances(cr *matrixv1alpha1.Synapse, typ matrixv1alpha1.SynapseWorkerType) []string {
+	if !hasWorker(cr, typ) {
+		return nil
+	}
+	return []string{workerName(cr, typ)}
+}
+
+// WorkerConfigKey returns the ConfigMap key for the config file of workers
+// of type typ.
+func workerConfigKey(typ matrixv1alpha1.SynapseWorkerType) string {
+	return string(typ) + ".yaml"
+}
+
+const workerTypeLabel = "synapse_worker"
+
+func workerLabels(name string, typ matrixv1alpha1.SynapseWorkerType) map[string]string {
+	return map[string]string{"app": "synapse-worker", "synapse_cr": name, workerTypeLabel: string(typ)}
+}
+
+// AllWorkersLabels selects the workers of all types belonging to the named
+// CR.
+func allWorkersLabels(name string) map[string]string {
+	return map[string]string{"app": "synapse-worker", "synapse_cr": name}
+}
+
+func workersConfigMap(cr *matrixv1alpha1.Synapse) (*v1.ConfigMap, error) {
+	data := make(map[string]string)
+	for _, w := range cr.Spec.Workers {
+		p, err := synapseconf.GenerateWorkerYAML(&synapseconf.WorkerConfig{
+			App:       workerApp,
+			Resources: workerResources[w.Type],
+			MediaRepo: w.Type == matrixv1alpha1.WorkerMedia,
+		})
+		if err != nil {
+			return nil, err
+		}
+		data[workerConfigKey(w.Type)] = string(p)
+	}
+
+	return &v1.ConfigMap{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workersConfigMapName(cr),
+			Namespace: cr.Namespace,
+			Labels:    allWorkersLabels(cr.Name),
+		},
+		Data: data,
+	}, nil
+}
+
+func replicationService(cr *matrixv1alpha1.Synapse) *v1.Service {
+	return &v1.Service{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      replicationServiceName(cr),
+			Namespace: cr.Namespace,
+			Labels:    synapseLabels(cr.Name),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeClusterIP,
+			Selector: synapseLabels(cr.Name),
+			Ports: []v1.ServicePort{{
+				Name:       "replication",
+				Protocol:   v1.ProtocolTCP,
+				Port:       synapseconf.ReplicationHTTPPort,
+				TargetPort: intstr.FromString("replication"),
+			}},
+		},
+	}
+}
+
+// WorkerService returns the Service in front of the workers of type typ.
+// Only worker types serving HTTP resources get one.
+func workerService(cr *matrixv1alpha1.Synapse, typ matrixv1alpha1.SynapseWorkerType) *v1.Service {
+	return &v1.Service{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workerName(cr, typ),
+			Namespace: cr.Namespace,
+			Labels:    workerLabels(cr.Name, typ),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeClusterIP,
+			Selector: workerLabels(cr.Name, typ),
+			Ports: []v1.ServicePort{{
+				Name:       "http",
+				Protocol:   v1.ProtocolTCP,
+				Port:       synapseHTTPPort,
+				TargetPort: intstr.FromString("http"),
+			}},
+		},
+	}
+}
+
+// WorkerPodConfigDigest extends podConfigDigest by the worker's config
+// file.
+func workerPodConfigDigest(secret *v1.Secret, cm, workersCM *v1.ConfigMap, typ matrixv1alpha1.SynapseWorkerType) string {
+	h := sha256.New()
+	h.Write([]byte(podConfigDigest(secret, cm)))
+	h.Write([]byte{0})
+	h.Write([]byte(workersCM.Data[workerConfigKey(typ)]))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func workerDeployment(cr *matrixv1alpha1.Synapse, w matrixv1alpha1.SynapseWorker, secret *v1.Secret, cm, workersCM *v1.ConfigMap) *appsv1.Deployment {
+	ls := workerLabels(cr.Name, w.Type)
+	image := matrixv1alpha1.DefaultImage
+	if cr.Spec.Image != "" {
+		image = cr.Spec.Image
+	}
+
+	// Only media workers need the data volume (for the media store).
+	// The others get a scratch volume for the pid file.
+	strategy := deploymentStrategy(false)
+	volumes := synapseVolumes(cr, secret, cm)
+	if w.Type == matrixv1alpha1.WorkerMedia {
+		strategy = synapseDeploymentStrategy(cr)
+	} else {
+		for i := range volumes {
+			if volumes[i].Name == "data" {
+				volumes[i].VolumeSource = v1.VolumeSource{
+					EmptyDir: &v1.EmptyDirVolumeSource{},
+				}
+			}
+		}
+	}
+	volumes = append(volumes,
+		v1.Volume{
+			Name: "worker-config-src",
+			VolumeSource: v1.VolumeSource{
+				Projected: &v1.ProjectedVolumeSource{
+					Sources: []v1.VolumeProjection{
+						{
+							ConfigMap: &v1.ConfigMapProjection{
+								LocalObjectReference: v1.LocalObjectReference{
+									Name: cm.Name,
+								},
+								Items: []v1.KeyToPath{{
+									Key:  "homeserver.yaml",
+									Path: "homeserver.yaml",
+								}},
+							},
+						},
+						{
+							ConfigMap: &v1.ConfigMapProjection{
+								LocalObjectReference: v1.LocalObjectReference{
+									Name: workersCM.Name,
+								},
+								Items: []v1.KeyToPath{{
+									Key:  workerConfigKey(w.Type),
+									Path: "worker.yaml",
+								}},
+							},
+						},
+					},
+				},
+			},
+		},
+		v1.Volume{
+			Name: "worker-config",
+			VolumeSource: v1.VolumeSource{
+				EmptyDir: &v1.EmptyDirVolumeSource{},
+			},
+		},
+	)
+
+	var ports []v1.ContainerPort
+	if len(workerResources[w.Type]) > 0 {
+		ports = []v1.ContainerPort{{
+			ContainerPort: synapseHTTPPort,
+			Name:          "http",
+		}}
+	}
+
+	// Singletons are referred to by name in homeserver.yaml, the others
+	// are told apart by their pod name.
+	workerNameEnv := v1.EnvVar{Name: "WORKER_NAME"}
+	if w.Type.Singleton() {
+		workerNameEnv.Value = workerName(cr, w.Type)
+	} else {
+		workerNameEnv.ValueFrom = &v1.EnvVarSource{
+			FieldRef: &v1.ObjectFieldSelector{
+				FieldPath: "metadata.name",
+			},
+		}
+	}
+
+	return &appsv1.Deployment{
+		// Needed for server-side apply.
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workerName(cr, w.Type),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: w.Replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			Strategy: strategy,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ls,
+					Annotations: map[string]string{
+						podConfigAnnotationKey: workerPodConfigDigest(secret, cm, workersCM, w.Type),
+					},
+				},
+				Spec: v1.PodSpec{
+					Volumes: volumes,
+					InitContainers: []v1.Container{{
+						Image: image,
+						Name:  "worker-config",
+						Command: []string{"sh", "-c",
+							`cp /config-src/*.yaml "$CONFIG_DIR" && ` +
+								`printf 'worker_name: "%s"\n' "$WORKER_NAME" >"$CONFIG_DIR/worker_name.yaml"`,
+						},
+						Env: []v1.EnvVar{
+							{Name: "CONFIG_DIR", Value: workerConfigDir},
+							workerNameEnv,
+						},
+						VolumeMounts: []v1.VolumeMount{
+							{
+								Name:      "worker-config-src",
+								MountPath: "/config-src",
+								ReadOnly:  true,
+							},
+							{
+								Name:      "worker-config",
+								MountPath: workerConfigDir,
+							},
+						},
+					}},
+					Containers: []v1.Container{{
+						Image: image,
+						Name:  "synapse",
+						Env: []v1.EnvVar{
+							// Understood by the start script of
+							// the Synapse image.
+							{Name: "SYNAPSE_WORKER", Value: workerApp},
+							{Name: "SYNAPSE_CONFIG_PATH", Value: workerConfigDir},
+						},
+						Ports: ports,
+						VolumeMounts: append(synapseVolumeMounts(cr), v1.VolumeMount{
+							Name:      "worker-config",
+							MountPath: workerConfigDir,
+							ReadOnly:  true,
+						}),
+					}},
+				},
+			},
+		},
+	}
+}
+
+// WorkerIngressRoutes returns the routes sending requests to workers. Only
+// endpoints expressible as Ingress paths are covered, the main process
+// serves the remaining ones. See docs/workers.md in the Synapse
+// repository for the list of endpoints each worker type can handle.
+func workerIngressRoutes(cr *matrixv1alpha1.Synapse) []ingressRoute {
+	port := intstr.FromString("http")
+	var routes []ingressRoute
+
+	if hasWorker(cr, matrixv1alpha1.WorkerMedia) {
+		routes = append(routes, ingressRoute{
+			Path:        "/_matrix/media",
+			ServiceName: workerName(cr, matrixv1alpha1.WorkerMedia),
+			ServicePort: port,
+		})
+	}
+
+	if hasWorker(cr, matrixv1alpha1.WorkerGeneric) {
+		svc := workerName(cr, matrixv1alpha1.WorkerGeneric)
+		exact := func(p ...string) {
+			for _, p := range p {
+				routes = append(routes, ingressRoute{Path: p, Exact: true, ServiceName: svc, ServicePort: port})
+			}
+		}
+		prefix := func(p ...string) {
+			for _, p := range p {
+				routes = append(routes, ingressRoute{Path: p, ServiceName: svc, ServicePort: port})
+			}
+		}
+
+		// Sync requests.
+		exact(
+			"/_matrix/client/r0/sync",
+			"/_matrix/client/v2_alpha/sync",
+			"/_matrix/client/api/v1/events",
+			"/_matrix/client/r0/events",
+			"/_matrix/client/v2_alpha/events",
+			"/_matrix/client/api/v1/initialSync",
+			"/_matrix/client/r0/initialSync",
+		)
+		// Client API requests.
+		for _, v := range []string{"api/v1", "r0", "unstable"} {
+			base := "/_matrix/client/" + v + "/"
+			exact(
+				base+"publicRooms",
+				base+"login",
+				base+"account/3pid",
+				base+"keys/query",
+				base+"keys/changes",
+				base+"voip/turnServer",
+				base+"joined_groups",
+				base+"publicised_groups",
+			)
+			prefix(
+				base+"publicised_groups",
+				base+"profile",
+			)
+		}
+		exact(
+			"/_matrix/client/r0/register",
+			"/_matrix/client/unstable/register",
+		)
+		// Federation requests.
+		for _, p := range []string{
+			"event", "state", "state_ids", "backfill",
+			"get_missing_events", "publicRooms", "query",
+			"make_join", "make_leave", "send_join", "send_leave",
+			"invite", "query_auth", "event_auth",
+			"exchange_third_party_invite", "user/devices", "send",
+		} {
+			prefix("/_matrix/federation/v1/" + p)
+		}
+		prefix(
+			"/_matrix/federation/v2/send_join",
+			"/_matrix/federation/v2/send_leave",
+			"/_matrix/federation/v2/invite",
+			"/_matrix/key/v2/query",
+		)
+		exact("/_matrix/federation/v1/get_groups_publicised")
+	}
+
+	return routes
+}
+
+// ReconcileWorkers creates, updates or deletes the worker Deployments, their
+// Services and config files according to the CR.
+func (r *SynapseReconciler) reconcileWorkers(ctx context.Context, log logr.Logger, cr *matrixv1alpha1.Synapse, secret *v1.Secret, cm *v1.ConfigMap) (ctrl.Result, error) {
+	if !hasWorkers(cr) {
+		for _, obj := range []object{
+			&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: replicationServiceName(cr), Namespace: cr.Namespace}},
+			&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: workersConfigMapName(cr), Namespace: cr.Namespace}},
+		} {
+			deleted, err := r.deleteIfControlled(ctx, log, cr, obj)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+		return r.deleteStaleWorkers(ctx, log, cr)
+	}
+
+	workersCM, err := workersConfigMap(cr)
+	if err != nil {
+		log.Error(err, "generate worker config")
+		r.Recorder.Eventf(cr, v1.EventTypeWarning, eventReasonConfigGenerationFailed,
+			"generate worker config: %v", err)
+		return ctrl.Result{}, err
+	}
+	objs := []object{workersCM, replicationService(cr)}
+	for _, w := range cr.Spec.Workers {
+		if len(workerResources[w.Type]) > 0 {
+			objs = append(objs, workerService(cr, w.Type))
+		}
+	}
+	for _, obj := range objs {
+		if err := r.apply(ctx, log, cr, obj); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	for _, w := range cr.Spec.Workers {
+		dep := workerDeployment(cr, w, secret, cm, workersCM)
+		if err := r.apply(ctx, log, cr, dep); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return r.deleteStaleWorkers(ctx, log, cr)
+}
+
+// DeleteStaleWorkers deletes the Deployments and Services of worker types
+// no longer present in the CR.
+func (r *SynapseReconciler) deleteStaleWorkers(ctx context.Context, log logr.Logger, cr *matrixv1alpha1.Synapse) (ctrl.Result, error) {
+	for _, list := range []runtime.Object{
+		&appsv1.DeploymentList{},
+		&v1.ServiceList{},
+	} {
+		err := r.List(ctx, list,
+			client.InNamespace(cr.Namespace),
+			client.MatchingLabels(allWorkersLabels(cr.Name)))
+		if err != nil {
+			log.Error(err, "list workers")
+			return ctrl.Result{}, err
+		}
+		items, err := apimeta.ExtractList(list)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		for _, item := range items {
+			obj, ok := item.(object)
+			if !ok {
+				continue
+			}
+			typ := matrixv1alpha1.SynapseWorkerType(obj.GetLabels()[workerTypeLabel])
+			_, isService := obj.(*v1.Service)
+			if hasWorker(cr, typ) && (!isService || len(workerResources[typ]) > 0) {
+				continue
+			}
+			deleted, err := r.deleteIfControlled(ctx, log, cr, obj)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+	}
+	return ctrl.Result{}, nil
+}
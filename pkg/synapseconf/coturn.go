@@ -0,0 +1,95 @@
+package synapseconf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A CoturnConfig describes a coturn TURN server serving the clients of a
+// Synapse homeserver.
+type CoturnConfig struct {
+	// authentication realm, usually the server name
+	Realm string
+	// UDP port for TURN requests (defaults to 3478)
+	ListeningPort int
+	// range of UDP ports used for relaying media
+	MinRelayPort int
+	MaxRelayPort int
+}
+
+// DefaultCoturnListeningPort is the standard TURN port.
+const DefaultCoturnListeningPort = 3478
+
+// CoturnDeniedPeerIPRanges lists the address ranges coturn must not relay
+// to, keeping clients from reaching the cluster network through the TURN
+// server. Taken from Synapse's docs/turn-howto.md.
+var CoturnDeniedPeerIPRanges = []string{
+	"0.0.0.0-0.255.255.255",
+	"10.0.0.0-10.255.255.255",
+	"100.64.0.0-100.127.255.255",
+	"127.0.0.0-127.255.255.255",
+	"169.254.0.0-169.254.255.255",
+	"172.16.0.0-172.31.255.255",
+	"192.0.0.0-192.0.0.255",
+	"192.0.2.0-192.0.2.255",
+	"192.88.99.0-192.88.99.255",
+	"192.168.0.0-192.168.255.255",
+	"198.18.0.0-198.19.255.255",
+	"198.51.100.0-198.51.100.255",
+	"203.0.113.0-203.0.113.255",
+	"240.0.0.0-255.255.255.255",
+	"::1",
+	"64:ff9b::-64:ff9b::ffff:ffff",
+	"::ffff:0.0.0.0-::ffff:255.255.255.255",
+	"100::-100::ffff:ffff:ffff:ffff",
+	"2001::-2001:1ff:ffff:ffff:ffff:ffff:ffff:ffff",
+	"2002::-2002:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+	"fc00::-fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+	"fe80::-febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+}
+
+// GenerateCoturnConfig outputs a turnserver.conf for the provided
+// CoturnConfig. The server authenticates clients with the TURN REST API
+// scheme Synapse implements; the shared secret is not part of the file and
+// must be passed with --static-auth-secret.
+func GenerateCoturnConfig(config *CoturnConfig) ([]byte, error) {
+	if config.Realm == "" {
+		return nil, errors.New("coturn: realm must not be empty")
+	}
+	if strings.ContainsAny(config.Realm, "\r\n") {
+		return nil, fmt.Errorf("coturn: invalid realm %q", config.Realm)
+	}
+	port := config.ListeningPort
+	if port == 0 {
+		port = DefaultCoturnListeningPort
+	}
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("coturn: listening port %d out of range", port)
+	}
+	if config.MinRelayPort < 1 || config.MaxRelayPort > 65535 || config.MinRelayPort > config.MaxRelayPort {
+		return nil, fmt.Errorf("coturn: invalid relay port range %d-%d",
+			config.MinRelayPort, config.MaxRelayPort)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "listening-port=%d\n", port)
+	fmt.Fprintf(&b, "min-port=%d\n", config.MinRelayPort)
+	fmt.Fprintf(&b, "max-port=%d\n", config.MaxRelayPort)
+	fmt.Fprintf(&b, "realm=%s\n", config.Realm)
+	b.WriteString("use-auth-secret\n")
+	b.WriteString("fingerprint\n")
+	// Only UDP is exposed and TLS would need certificates.
+	b.WriteString("no-tcp-relay\n")
+	b.WriteString("no-tls\n")
+	b.WriteString("no-dtls\n")
+	b.WriteString("no-cli\n")
+	b.WriteString("log-file=stdout\n")
+	b.WriteString("user-quota=12\n")
+	b.WriteString("total-quota=1200\n")
+	for _, r := range CoturnDeniedPeerIPRanges {
+		fmt.Fprintf(&b, "denied-peer-ip=%s\n", r)
+	}
+	return b.Bytes(), nil
+}
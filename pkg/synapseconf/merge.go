@@ -0,0 +1,126 @@
+package synapseconf
+
+import (
+	"fmt"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MergeKeys maps the names of sequences in Synapse's config whose elements
+// are identified by a key to the name of that key. MergeYAML merges such
+// sequences element by element.
+var mergeKeys = map[string]string{
+	"listeners":           "port",
+	"worker_listeners":    "port",
+	"trusted_key_servers": "server_name",
+	"oidc_providers":      "idp_id",
+}
+
+// MergeYAML deep-merges the YAML documents in overrides, in order, onto
+// base and returns the result. Each document must be a mapping or empty.
+//
+// Values are merged as follows:
+//
+//   - mappings are merged key by key, keeping the order of base and
+//     appending new keys;
+//   - a null value in an override removes the key from the result;
+//   - the sequences listeners and worker_listeners (keyed by port),
+//     trusted_key_servers (keyed by server_name) and oidc_providers
+//     (keyed by idp_id) are merged element by element, with elements
+//     matching no existing key appended;
+//   - any other value, including other sequences, replaces the one in base.
+func MergeYAML(base []byte, overrides ...[]byte) ([]byte, error) {
+	var merged yaml.MapSlice
+	if err := yaml.Unmarshal(base, &merged); err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+	for i, p := range overrides {
+		var m yaml.MapSlice
+		if err := yaml.Unmarshal(p, &m); err != nil {
+			return nil, fmt.Errorf("override %d: %w", i, err)
+		}
+		merged = mergeMapSlice(merged, m)
+	}
+
+	return yaml.Marshal(merged)
+}
+
+func mergeMapSlice(dst, src yaml.MapSlice) yaml.MapSlice {
+	for _, item := range src {
+		i := indexMapSlice(dst, item.Key)
+		if item.Value == nil {
+			if i >= 0 {
+				dst = append(dst[:i:i], dst[i+1:]...)
+			}
+			continue
+		}
+		if i < 0 {
+			dst = append(dst, item)
+			continue
+		}
+		dst[i].Value = mergeValue(dst[i].Key, dst[i].Value, item.Value)
+	}
+	return dst
+}
+
+func mergeValue(key, dst, src interface{}) interface{} {
+	switch srcVal := src.(type) {
+	case yaml.MapSlice:
+		if dstVal, ok := dst.(yaml.MapSlice); ok {
+			return mergeMapSlice(dstVal, srcVal)
+		}
+	case []interface{}:
+		name, _ := key.(string)
+		dstVal, ok := dst.([]interface{})
+		if mk := mergeKeys[name]; mk != "" && ok {
+			return mergeKeyedList(dstVal, srcVal, mk)
+		}
+	}
+	return src
+}
+
+// MergeKeyedList merges the mappings in src into those in dst having the
+// same value for key. Other elements of src are appended.
+func mergeKeyedList(dst, src []interface{}, key string) []interface{} {
+	out := append([]interface{}(nil), dst...)
+	for _, s := range src {
+		sm, ok := s.(yaml.MapSlice)
+		j := -1
+		if ok {
+			j = indexKeyedList(out, key, sm)
+		}
+		if j < 0 {
+			out = append(out, s)
+			continue
+		}
+		out[j] = mergeMapSlice(out[j].(yaml.MapSlice), sm)
+	}
+	return out
+}
+
+func indexKeyedList(l []interface{}, key string, m yaml.MapSlice) int {
+	i := indexMapSlice(m, key)
+	if i < 0 {
+		return -1
+	}
+	for j, e := range l {
+		em, ok := e.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		if k := indexMapSlice(em, key); k >= 0 && reflect.DeepEqual(em[k].Value, m[i].Value) {
+			return j
+		}
+	}
+	return -1
+}
+
+func indexMapSlice(m yaml.MapSlice, key interface{}) int {
+	for i := range m {
+		if reflect.DeepEqual(m[i].Key, key) {
+			return i
+		}
+	}
+	return -1
+}
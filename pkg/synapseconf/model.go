@@ -0,0 +1,214 @@
+package synapseconf
+
+// The types below model the commonly used sections of Synapse's
+// configuration files. See docs/sample_config.yaml in the Synapse
+// repository for the meaning of the individual settings.
+
+// Homeserver models homeserver.yaml.
+type Homeserver struct {
+	ServerName        string `yaml:"server_name"`
+	PidFile           string `yaml:"pid_file"`
+	SigningKeyPath    string `yaml:"signing_key_path"`
+	LogConfig         string `yaml:"log_config"`
+	MediaStorePath    string `yaml:"media_store_path"`
+	UploadsPath       string `yaml:"uploads_path"`
+	WebClientLocation string `yaml:"web_client_location,omitempty"`
+	PublicBaseURL     string `yaml:"public_baseurl"`
+	AdminContact      string `yaml:"admin_contact,omitempty"`
+
+	// Keys no longer used for signing, by key ID.
+	OldSigningKeys map[string]OldSigningKey `yaml:"old_signing_keys,omitempty"`
+
+	Listeners []Listener `yaml:"listeners"`
+
+	// HTTP replication listeners of the Synapse processes, by instance
+	// name. The main process is called "main".
+	InstanceMap map[string]InstanceLocation `yaml:"instance_map,omitempty"`
+
+	// Tasks that can be moved to workers, named by worker_name. The main
+	// process handles them if unset.
+	FederationSenderInstances   []string `yaml:"federation_sender_instances,omitempty"`
+	PusherInstances             []string `yaml:"pusher_instances,omitempty"`
+	NotifyAppservicesFromWorker string   `yaml:"notify_appservices_from_worker,omitempty"`
+	EnableMediaRepo             *bool    `yaml:"enable_media_repo,omitempty"`
+
+	FederationIPRangeBlacklist []string `yaml:"federation_ip_range_blacklist"`
+
+	Database Database `yaml:"database"`
+	Redis    *Redis   `yaml:"redis,omitempty"`
+	Email    *Email   `yaml:"email,omitempty"`
+
+	TurnURIs         []string `yaml:"turn_uris,omitempty"`
+	TurnSharedSecret string   `yaml:"turn_shared_secret,omitempty"`
+	TurnUserLifetime string   `yaml:"turn_user_lifetime,omitempty"`
+	TurnAllowGuests  *bool    `yaml:"turn_allow_guests,omitempty"`
+
+	MaxUploadSize         string                 `yaml:"max_upload_size,omitempty"`
+	MediaRetention        *MediaRetention        `yaml:"media_retention,omitempty"`
+	ThumbnailSizes        []ThumbnailSize        `yaml:"thumbnail_sizes,omitempty"`
+	MediaStorageProviders []MediaStorageProvider `yaml:"media_storage_providers,omitempty"`
+
+	URLPreviewEnabled          bool     `yaml:"url_preview_enabled,omitempty"`
+	URLPreviewIPRangeBlacklist []string `yaml:"url_preview_ip_range_blacklist,omitempty"`
+	URLPreviewIPRangeWhitelist []string `yaml:"url_preview_ip_range_whitelist,omitempty"`
+	MaxSpiderSize              string   `yaml:"max_spider_size,omitempty"`
+
+	EnableRegistration                    bool     `yaml:"enable_registration,omitempty"`
+	EnableRegistrationWithoutVerification bool     `yaml:"enable_registration_without_verification,omitempty"`
+	RegistrationsRequire3PID              []string `yaml:"registrations_require_3pid,omitempty"`
+	RegistrationRequiresToken             bool     `yaml:"registration_requires_token,omitempty"`
+	AutoJoinRooms                         []string `yaml:"auto_join_rooms,omitempty"`
+	EnableRegistrationCaptcha             bool     `yaml:"enable_registration_captcha,omitempty"`
+	RecaptchaPublicKey                    string   `yaml:"recaptcha_public_key,omitempty"`
+	RecaptchaPrivateKey                   string   `yaml:"recaptcha_private_key,omitempty"`
+
+	OIDCProviders []OIDCProvider `yaml:"oidc_providers,omitempty"`
+
+	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+	MacaroonSecretKey        string `yaml:"macaroon_secret_key"`
+	FormSecret               string `yaml:"form_secret"`
+
+	EnableMetrics     bool               `yaml:"enable_metrics"`
+	ReportStats       bool               `yaml:"report_stats"`
+	TrustedKeyServers []TrustedKeyServer `yaml:"trusted_key_servers"`
+}
+
+// An OldSigningKey is the verify key of a signing key no longer in use.
+type OldSigningKey struct {
+	// unpadded base64 encoding of the public key
+	Key string `yaml:"key"`
+	// time the key was retired, in milliseconds since the epoch
+	ExpiredTS int64 `yaml:"expired_ts"`
+}
+
+// An InstanceLocation is the address of a process's HTTP replication
+// listener.
+type InstanceLocation struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+}
+
+// A Listener configures a port Synapse listens on.
+type Listener struct {
+	Port       int                `yaml:"port"`
+	TLS        bool               `yaml:"tls"`
+	Type       string             `yaml:"type"`
+	XForwarded bool               `yaml:"x_forwarded,omitempty"`
+	Resources  []ListenerResource `yaml:"resources,omitempty"`
+}
+
+// A ListenerResource names resources served on an HTTP listener.
+type ListenerResource struct {
+	Names    []string `yaml:"names"`
+	Compress bool     `yaml:"compress"`
+}
+
+// Database selects and configures the database backend.
+type Database struct {
+	Name string       `yaml:"name"`
+	Args DatabaseArgs `yaml:"args"`
+}
+
+// DatabaseArgs are passed to the database driver. Only the ones relevant to
+// the selected backend are set.
+type DatabaseArgs struct {
+	User     string `yaml:"user,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Database string `yaml:"database"`
+	Host     string `yaml:"host,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	CPMin    int    `yaml:"cp_min,omitempty"`
+	CPMax    int    `yaml:"cp_max,omitempty"`
+}
+
+// Redis configures the connection to a Redis server.
+type Redis struct {
+	Enabled  bool   `yaml:"enabled"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// Email configures sending email through an SMTP server.
+type Email struct {
+	SMTPHost                 string `yaml:"smtp_host"`
+	SMTPPort                 int    `yaml:"smtp_port"`
+	SMTPUser                 string `yaml:"smtp_user,omitempty"`
+	SMTPPass                 string `yaml:"smtp_pass,omitempty"`
+	RequireTransportSecurity bool   `yaml:"require_transport_security"`
+	ForceTLS                 bool   `yaml:"force_tls,omitempty"`
+	NotifFrom                string `yaml:"notif_from"`
+	AppName                  string `yaml:"app_name,omitempty"`
+	EnableNotifs             bool   `yaml:"enable_notifs"`
+}
+
+// MediaRetention configures when cached media is purged.
+type MediaRetention struct {
+	LocalMediaLifetime  string `yaml:"local_media_lifetime,omitempty"`
+	RemoteMediaLifetime string `yaml:"remote_media_lifetime,omitempty"`
+}
+
+// A ThumbnailSize is a thumbnail Synapse pre-generates for uploaded
+// images.
+type ThumbnailSize struct {
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+	// crop or scale
+	Method string `yaml:"method"`
+}
+
+// A MediaStorageProvider is an additional store for media files, besides
+// the local media store.
+type MediaStorageProvider struct {
+	Module string `yaml:"module"`
+	// whether to store files uploaded by local users
+	StoreLocal bool `yaml:"store_local"`
+	// whether to store files downloaded from remote servers
+	StoreRemote bool `yaml:"store_remote"`
+	// whether to wait for the upload before completing the request
+	StoreSynchronous bool              `yaml:"store_synchronous"`
+	Config           map[string]string `yaml:"config,omitempty"`
+}
+
+// An OIDCProvider configures single sign-on through an OpenID Connect
+// provider.
+type OIDCProvider struct {
+	IdpID               string                   `yaml:"idp_id"`
+	IdpName             string                   `yaml:"idp_name,omitempty"`
+	Issuer              string                   `yaml:"issuer"`
+	ClientID            string                   `yaml:"client_id"`
+	ClientSecret        string                   `yaml:"client_secret,omitempty"`
+	Scopes              []string                 `yaml:"scopes,omitempty"`
+	UserMappingProvider *OIDCUserMappingProvider `yaml:"user_mapping_provider,omitempty"`
+}
+
+// OIDCUserMappingProvider configures how user attributes are derived from
+// ID token claims.
+type OIDCUserMappingProvider struct {
+	Config OIDCUserMappingConfig `yaml:"config"`
+}
+
+// OIDCUserMappingConfig holds the Jinja2 templates of the default user
+// mapping provider.
+type OIDCUserMappingConfig struct {
+	LocalpartTemplate   string `yaml:"localpart_template,omitempty"`
+	DisplayNameTemplate string `yaml:"display_name_template,omitempty"`
+	EmailTemplate       string `yaml:"email_template,omitempty"`
+}
+
+// A TrustedKeyServer is asked for the signing keys of other servers.
+type TrustedKeyServer struct {
+	ServerName string `yaml:"server_name"`
+}
+
+// Worker models the worker-specific config file loaded in addition to
+// homeserver.yaml by worker processes.
+type Worker struct {
+	App       string     `yaml:"worker_app"`
+	Listeners []Listener `yaml:"worker_listeners"`
+	LogConfig string     `yaml:"worker_log_config"`
+
+	// Overrides the setting in homeserver.yaml, which turns the media
+	// repository off on the main process.
+	EnableMediaRepo *bool `yaml:"enable_media_repo,omitempty"`
+}
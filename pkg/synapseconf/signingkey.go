@@ -0,0 +1,128 @@
+package synapseconf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Synapse encodes keys as base64 without padding.
+var unpaddedBase64 = base64.StdEncoding.WithPadding(base64.NoPadding)
+
+// A SigningKey is an ed25519 key Synapse signs events and requests with.
+type SigningKey struct {
+	// key version, e.g. a_abcd
+	Version string
+	// ed25519 private key seed
+	Seed []byte
+}
+
+// GenerateSigningKey generates an ed25519 private key suitably encoded for use
+// as synapse signing key.
+func GenerateSigningKey(keyID string) ([]byte, error) {
+	_, sk, err := ed25519.GenerateKey(randReader)
+	if err != nil {
+		return nil, err
+	}
+	return FormatSigningKeys(SigningKey{Version: keyID, Seed: sk.Seed()}), nil
+}
+
+// KeyID returns the ID other servers know the key by, e.g. ed25519:a_abcd.
+func (k *SigningKey) KeyID() string {
+	return "ed25519:" + k.Version
+}
+
+// VerifyKey returns the unpadded base64 encoding of k's public key, as
+// published in old_signing_keys.
+func (k *SigningKey) VerifyKey() (string, error) {
+	pk, err := DeriveVerifyKey(k.Seed)
+	if err != nil {
+		return "", err
+	}
+	return unpaddedBase64.EncodeToString(pk), nil
+}
+
+// DeriveVerifyKey returns the ed25519 public key belonging to seed.
+func DeriveVerifyKey(seed []byte) (ed25519.PublicKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("bad seed length %d, want %d", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey), nil
+}
+
+// ParseSigningKeys parses the contents of a Synapse signing key file. Each
+// non-empty line holds one key in the form
+//
+//	ed25519 VERSION SEED
+//
+// where SEED is the base64-encoded private key seed.
+func ParseSigningKeys(p []byte) ([]SigningKey, error) {
+	var keys []SigningKey
+	sc := bufio.NewScanner(bytes.NewReader(p))
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 3 fields, got %d", n, len(fields))
+		}
+		if fields[0] != "ed25519" {
+			return nil, fmt.Errorf("line %d: unsupported algorithm %q", n, fields[0])
+		}
+		seed, err := unpaddedBase64.DecodeString(strings.TrimRight(fields[2], "="))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("line %d: bad seed length %d, want %d", n, len(seed), ed25519.SeedSize)
+		}
+		keys = append(keys, SigningKey{Version: fields[1], Seed: seed})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key found")
+	}
+	return keys, nil
+}
+
+// FormatSigningKeys returns a signing key file holding keys.
+func FormatSigningKeys(keys ...SigningKey) []byte {
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, "ed25519 %s %s\n", k.Version, unpaddedBase64.EncodeToString(k.Seed))
+	}
+	return b.Bytes()
+}
+
+// ParseOldSigningKeys parses the YAML encoding of an old_signing_keys
+// section, as produced by FormatOldSigningKeys. An empty document yields
+// an empty map.
+func ParseOldSigningKeys(p []byte) (map[string]OldSigningKey, error) {
+	keys := make(map[string]OldSigningKey)
+	if err := yaml.UnmarshalStrict(p, &keys); err != nil {
+		return nil, err
+	}
+	for id, k := range keys {
+		if !strings.HasPrefix(id, "ed25519:") {
+			return nil, fmt.Errorf("old signing key %q: unsupported algorithm", id)
+		}
+		if _, err := unpaddedBase64.DecodeString(k.Key); err != nil {
+			return nil, fmt.Errorf("old signing key %q: %w", id, err)
+		}
+	}
+	return keys, nil
+}
+
+// FormatOldSigningKeys returns the YAML encoding of the old_signing_keys
+// section holding keys.
+func FormatOldSigningKeys(keys map[string]OldSigningKey) ([]byte, error) {
+	return yaml.Marshal(keys)
+}
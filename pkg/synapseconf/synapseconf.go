@@ -3,34 +3,31 @@
 package synapseconf
 
 import (
-	"bytes"
-	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"text/template"
-)
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 
-// GenerateSigningKey generates an ed25519 private key suitably encoded for use
-// as synapse signing key.
-func GenerateSigningKey(keyID string) ([]byte, error) {
-	_, sk, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	b64Key := base64.StdEncoding.WithPadding(base64.NoPadding).EncodeToString(sk.Seed())
-
-	var b bytes.Buffer
-	fmt.Fprintf(&b, "ed25519 %s %s\n", keyID, b64Key)
+	"gopkg.in/yaml.v2"
+)
 
-	return b.Bytes(), nil
-}
+// RandReader is the source of randomness for keys and secrets. Tests replace
+// it to simulate RNG failures.
+var randReader io.Reader = rand.Reader
 
 // A HomeserverConfig describes the basic configuration for a Synapse
 // homeserver.
 type HomeserverConfig struct {
 	// public DNS name
 	ServerName string
+	// URL clients use to reach Synapse (defaults to https://ServerName/)
+	PublicBaseURL string
 	// redirect web clients to this URL (probably a riot-web instance)
 	WebClientLocation string
 	// URI to reach an admin with (example: mailto:admin@example.com)
@@ -47,8 +44,45 @@ type HomeserverConfig struct {
 	// If set, configure for Postgres DB. Otherwise, use sqlite3.
 	PostgresConfig *PostgresConfig
 
-	// included verbatim at the tail of homeserver.yaml
-	IncludeConfigYAML []byte
+	// If set, use Redis for replication between Synapse processes.
+	RedisConfig *RedisConfig
+
+	// If set, send email through an SMTP server.
+	EmailConfig *EmailConfig
+
+	// If set, hand out credentials for a TURN server to clients.
+	TurnConfig *TurnConfig
+
+	// If set, store media in an S3-compatible object store.
+	S3StorageConfig *S3StorageConfig
+
+	// If set, tune the media repository.
+	MediaConfig *MediaConfig
+
+	// If set, configure user registration (disabled otherwise).
+	RegistrationConfig *RegistrationConfig
+
+	// OpenID Connect providers users can log in through, see
+	// ValidateOIDCProviders.
+	OIDCProviders []OIDCProviderConfig
+
+	// If set, accept HTTP replication requests from worker processes,
+	// which reach the main process through this host name.
+	ReplicationHost string
+	// Names of the workers taking over tasks from the main process.
+	FederationSenderInstances []string
+	PusherInstances           []string
+	AppserviceWorker          string
+	// Serve media from workers instead of the main process.
+	DisableMediaRepo bool
+
+	// YAML documents deep-merged, in order, on top of the generated
+	// homeserver.yaml (see MergeYAML)
+	ExtraConfigYAML [][]byte
+
+	// Verify keys of previously used signing keys, by key ID (e.g.
+	// ed25519:a_abcd).
+	OldSigningKeys map[string]OldSigningKey
 }
 
 // A PostgresConfig has the parameters for connecting to a Postgres database.
@@ -60,43 +94,585 @@ type PostgresConfig struct {
 	Port     string
 }
 
-//go:generate go run bake.go -o homeserver.yaml.go homeserverYAMLTemplateText:homeserver.yaml.in
+// A RedisConfig has the parameters for connecting to a Redis server.
+type RedisConfig struct {
+	Host     string
+	Port     string
+	Password string
+}
+
+// An EmailConfig has the parameters for sending email through an SMTP
+// server.
+type EmailConfig struct {
+	SMTPHost string
+	SMTPPort string
+	SMTPUser string
+	SMTPPass string
+	// require STARTTLS
+	RequireTransportSecurity bool
+	// use TLS from the start (SMTPS)
+	ForceTLS bool
+	// sender address, see ValidateNotifFrom
+	NotifFrom    string
+	AppName      string
+	EnableNotifs bool
+}
+
+// A TurnConfig has the TURN server settings handed out to clients for VoIP
+// calls.
+type TurnConfig struct {
+	// e.g. turn:turn.example.com:3478?transport=udp
+	URIs []string
+	// secret shared with the TURN server for generating credentials
+	SharedSecret string
+	// lifetime of the generated credentials, e.g. 1h
+	UserLifetime string
+	// whether guests may use the TURN server (Synapse defaults to true)
+	AllowGuests *bool
+}
+
+// An S3StorageConfig has the parameters for storing media in an
+// S3-compatible object store through synapse-s3-storage-provider.
+type S3StorageConfig struct {
+	Bucket string
+	// e.g. http://minio:9000 (defaults to AWS)
+	EndpointURL string
+	Region      string
+	// static credentials (defaults to the boto3 credential chain)
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// A MediaConfig has the media repository settings, see
+// ValidateMediaConfig.
+type MediaConfig struct {
+	// e.g. 50M
+	MaxUploadSize string
+	// e.g. 90d; empty means forever
+	LocalMediaLifetime  string
+	RemoteMediaLifetime string
+	// if empty, Synapse's defaults apply
+	ThumbnailSizes []ThumbnailSize
+
+	URLPreviewEnabled bool
+	// defaults to DefaultFederationIPRangeBlacklist
+	URLPreviewIPRangeBlacklist []string
+	URLPreviewIPRangeWhitelist []string
+	// e.g. 10M
+	MaxSpiderSize string
+}
+
+// A RegistrationConfig has the settings for registering new accounts, see
+// ValidateRegistrationConfig.
+type RegistrationConfig struct {
+	Enabled bool
+	// acknowledge that open registration without verification invites
+	// spam
+	EnableWithoutVerification bool
+	// email or msisdn
+	RequiredThreepids []string
+	RequireToken      bool
+	// room aliases, e.g. #welcome:example.com
+	AutoJoinRooms []string
+	// reCAPTCHA is used if both are set
+	RecaptchaPublicKey  string
+	RecaptchaPrivateKey string
+}
+
+// An OIDCProviderConfig describes an OpenID Connect provider for single
+// sign-on.
+type OIDCProviderConfig struct {
+	// unique ID, e.g. keycloak
+	ID string
+	// name shown to users
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// defaults to openid
+	Scopes []string
+	// Jinja2 templates deriving user attributes from the ID token
+	// claims, e.g. {{ user.preferred_username }}
+	LocalpartTemplate   string
+	DisplayNameTemplate string
+	EmailTemplate       string
+}
+
+// S3StorageProviderModule is the media storage provider class of
+// synapse-s3-storage-provider.
+const S3StorageProviderModule = "s3_storage_provider.S3StorageProviderBackend"
 
-var homeserverYAMLTemplate = template.Must(
-	template.New("homeserver.yaml").Parse(homeserverYAMLTemplateText),
+// Defaults used by NewHomeserver for settings not specified in a
+// HomeserverConfig.
+const (
+	defaultPostgresUser     = "synapse"
+	defaultPostgresDatabase = "synapse"
+	defaultPostgresPort     = 5432
+	defaultRedisPort        = 6379
+	defaultSMTPPort         = 25
+	defaultSMTPSPort        = 465
 )
 
-// GenerateHomeserverYAML outputs a homeserver.yaml using the provided HomeserverConfig.
-func GenerateHomeserverYAML(config *HomeserverConfig) ([]byte, error) {
-	// Make a copy of the passed in config to allow for adjustments
-	c := new(HomeserverConfig)
-	*c = *config
+// DefaultFederationIPRangeBlacklist lists the address ranges Synapse must not
+// send federation requests to, taken from the default homeserver.yaml.
+var DefaultFederationIPRangeBlacklist = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"::1/128",
+	"fe80::/64",
+	"fc00::/7",
+}
+
+// NewHomeserver returns the homeserver.yaml model for the provided
+// HomeserverConfig. ExtraConfigYAML is not applied.
+func NewHomeserver(config *HomeserverConfig) (*Homeserver, error) {
+	hs := &Homeserver{
+		ServerName:        config.ServerName,
+		PidFile:           "/data/homeserver.pid",
+		SigningKeyPath:    "/data/homeserver.signing.key",
+		LogConfig:         "/data/homeserver.log.config",
+		MediaStorePath:    "/data/media",
+		UploadsPath:       "/data/uploads",
+		WebClientLocation: config.WebClientLocation,
+		PublicBaseURL:     config.PublicBaseURL,
+		AdminContact:      config.AdminContact,
+
+		Listeners: []Listener{{
+			Port:       8008,
+			Type:       "http",
+			XForwarded: true,
+			Resources: []ListenerResource{{
+				Names: []string{"client", "federation"},
+			}},
+		}},
+
+		FederationIPRangeBlacklist: DefaultFederationIPRangeBlacklist,
+
+		Database: Database{
+			Name: "sqlite3",
+			Args: DatabaseArgs{
+				Database: "/data/homeserver.db",
+			},
+		},
+
+		RegistrationSharedSecret: config.RegistrationSharedSecret,
+		MacaroonSecretKey:        config.MacaroonSecretKey,
+		FormSecret:               config.FormSecret,
+
+		OldSigningKeys: config.OldSigningKeys,
+
+		EnableMetrics: true,
+		ReportStats:   config.ReportStats,
+		TrustedKeyServers: []TrustedKeyServer{
+			{ServerName: "matrix.org"},
+		},
+	}
+
+	if hs.PublicBaseURL == "" {
+		hs.PublicBaseURL = "https://" + config.ServerName + "/"
+	}
+	for _, secret := range []*string{
+		&hs.RegistrationSharedSecret,
+		&hs.MacaroonSecretKey,
+		&hs.FormSecret,
+	} {
+		if *secret != "" {
+			continue
+		}
+		var err error
+		if *secret, err = randomString(64); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ReplicationHost != "" {
+		hs.Listeners = append(hs.Listeners, Listener{
+			Port: ReplicationHTTPPort,
+			Type: "http",
+			Resources: []ListenerResource{{
+				Names: []string{"replication"},
+			}},
+		})
+		hs.InstanceMap = map[string]InstanceLocation{
+			"main": {Host: config.ReplicationHost, Port: ReplicationHTTPPort},
+		}
+	}
+	hs.FederationSenderInstances = config.FederationSenderInstances
+	hs.PusherInstances = config.PusherInstances
+	hs.NotifyAppservicesFromWorker = config.AppserviceWorker
+	if config.DisableMediaRepo {
+		hs.EnableMediaRepo = new(bool)
+	}
+
+	if pg := config.PostgresConfig; pg != nil {
+		port, err := parsePort(pg.Port, defaultPostgresPort)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: %w", err)
+		}
+		hs.Database = Database{
+			Name: "psycopg2",
+			Args: DatabaseArgs{
+				User:     stringOr(pg.User, defaultPostgresUser),
+				Password: pg.Password,
+				Database: stringOr(pg.Database, defaultPostgresDatabase),
+				Host:     pg.Host,
+				Port:     port,
+				CPMin:    5,
+				CPMax:    10,
+			},
+		}
+	}
+	if rd := config.RedisConfig; rd != nil {
+		port, err := parsePort(rd.Port, defaultRedisPort)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		hs.Redis = &Redis{
+			Enabled:  true,
+			Host:     rd.Host,
+			Port:     port,
+			Password: rd.Password,
+		}
+	}
 
-	if c.RegistrationSharedSecret == "" {
-		c.RegistrationSharedSecret = randomString(64)
+	if ec := config.EmailConfig; ec != nil {
+		if err := ValidateNotifFrom(ec.NotifFrom); err != nil {
+			return nil, fmt.Errorf("email: %w", err)
+		}
+		def := defaultSMTPPort
+		if ec.ForceTLS {
+			def = defaultSMTPSPort
+		}
+		port, err := parsePort(ec.SMTPPort, def)
+		if err != nil {
+			return nil, fmt.Errorf("email: %w", err)
+		}
+		hs.Email = &Email{
+			SMTPHost:                 ec.SMTPHost,
+			SMTPPort:                 port,
+			SMTPUser:                 ec.SMTPUser,
+			SMTPPass:                 ec.SMTPPass,
+			RequireTransportSecurity: ec.RequireTransportSecurity,
+			ForceTLS:                 ec.ForceTLS,
+			NotifFrom:                ec.NotifFrom,
+			AppName:                  ec.AppName,
+			EnableNotifs:             ec.EnableNotifs,
+		}
 	}
-	if c.MacaroonSecretKey == "" {
-		c.MacaroonSecretKey = randomString(64)
+
+	if tc := config.TurnConfig; tc != nil {
+		if len(tc.URIs) == 0 {
+			return nil, errors.New("turn: no URIs")
+		}
+		hs.TurnURIs = tc.URIs
+		hs.TurnSharedSecret = tc.SharedSecret
+		hs.TurnUserLifetime = tc.UserLifetime
+		hs.TurnAllowGuests = tc.AllowGuests
+	}
+
+	if mc := config.MediaConfig; mc != nil {
+		if err := ValidateMediaConfig(mc); err != nil {
+			return nil, fmt.Errorf("media: %w", err)
+		}
+		hs.MaxUploadSize = mc.MaxUploadSize
+		if mc.LocalMediaLifetime != "" || mc.RemoteMediaLifetime != "" {
+			hs.MediaRetention = &MediaRetention{
+				LocalMediaLifetime:  mc.LocalMediaLifetime,
+				RemoteMediaLifetime: mc.RemoteMediaLifetime,
+			}
+		}
+		hs.ThumbnailSizes = mc.ThumbnailSizes
+		if mc.URLPreviewEnabled {
+			hs.URLPreviewEnabled = true
+			hs.URLPreviewIPRangeBlacklist = mc.URLPreviewIPRangeBlacklist
+			if hs.URLPreviewIPRangeBlacklist == nil {
+				hs.URLPreviewIPRangeBlacklist = DefaultFederationIPRangeBlacklist
+			}
+			hs.URLPreviewIPRangeWhitelist = mc.URLPreviewIPRangeWhitelist
+			hs.MaxSpiderSize = mc.MaxSpiderSize
+		}
+	}
+
+	if rc := config.RegistrationConfig; rc != nil {
+		if err := ValidateRegistrationConfig(rc); err != nil {
+			return nil, fmt.Errorf("registration: %w", err)
+		}
+		hs.EnableRegistration = rc.Enabled
+		hs.EnableRegistrationWithoutVerification = rc.EnableWithoutVerification
+		hs.RegistrationsRequire3PID = rc.RequiredThreepids
+		hs.RegistrationRequiresToken = rc.RequireToken
+		hs.AutoJoinRooms = rc.AutoJoinRooms
+		if rc.RecaptchaPublicKey != "" {
+			hs.EnableRegistrationCaptcha = true
+			hs.RecaptchaPublicKey = rc.RecaptchaPublicKey
+			hs.RecaptchaPrivateKey = rc.RecaptchaPrivateKey
+		}
+	}
+
+	if len(config.OIDCProviders) > 0 {
+		if err := ValidateOIDCProviders(config.OIDCProviders); err != nil {
+			return nil, fmt.Errorf("oidc_providers: %w", err)
+		}
+		for _, pc := range config.OIDCProviders {
+			p := OIDCProvider{
+				IdpID:        pc.ID,
+				IdpName:      pc.Name,
+				Issuer:       pc.Issuer,
+				ClientID:     pc.ClientID,
+				ClientSecret: pc.ClientSecret,
+				Scopes:       pc.Scopes,
+			}
+			if pc.LocalpartTemplate != "" || pc.DisplayNameTemplate != "" || pc.EmailTemplate != "" {
+				p.UserMappingProvider = &OIDCUserMappingProvider{
+					Config: OIDCUserMappingConfig{
+						LocalpartTemplate:   pc.LocalpartTemplate,
+						DisplayNameTemplate: pc.DisplayNameTemplate,
+						EmailTemplate:       pc.EmailTemplate,
+					},
+				}
+			}
+			hs.OIDCProviders = append(hs.OIDCProviders, p)
+		}
+	}
+
+	if sc := config.S3StorageConfig; sc != nil {
+		if sc.Bucket == "" {
+			return nil, errors.New("s3 storage: bucket must not be empty")
+		}
+		c := map[string]string{"bucket": sc.Bucket}
+		for k, v := range map[string]string{
+			"endpoint_url":      sc.EndpointURL,
+			"region_name":       sc.Region,
+			"access_key_id":     sc.AccessKeyID,
+			"secret_access_key": sc.SecretAccessKey,
+		} {
+			if v != "" {
+				c[k] = v
+			}
+		}
+		// Upload synchronously so the object store holds every file
+		// by the time Synapse reports success, even if the local
+		// media store doesn't survive a restart. StoreLocal makes the
+		// provider receive local uploads; whether the local media
+		// store persists is up to the volume backing it.
+		hs.MediaStorageProviders = []MediaStorageProvider{{
+			Module:           S3StorageProviderModule,
+			StoreLocal:       true,
+			StoreRemote:      true,
+			StoreSynchronous: true,
+			Config:           c,
+		}}
+	}
+
+	return hs, nil
+}
+
+// ValidateMediaConfig checks the media repository settings in mc. Sizes
+// are a number of bytes, optionally followed by K or M. Lifetimes are a
+// number of milliseconds or a number followed by one of the units ms, s,
+// m, h, d, w and y. IP ranges are in CIDR notation.
+func ValidateMediaConfig(mc *MediaConfig) error {
+	for _, sz := range []struct{ name, value string }{
+		{"max_upload_size", mc.MaxUploadSize},
+		{"max_spider_size", mc.MaxSpiderSize},
+	} {
+		if sz.value != "" && !IsSize(sz.value) {
+			return fmt.Errorf("%s: %q is not a size", sz.name, sz.value)
+		}
+	}
+	for _, d := range []struct{ name, value string }{
+		{"local_media_lifetime", mc.LocalMediaLifetime},
+		{"remote_media_lifetime", mc.RemoteMediaLifetime},
+	} {
+		if d.value != "" && !IsDuration(d.value) {
+			return fmt.Errorf("%s: %q is not a duration", d.name, d.value)
+		}
+	}
+	for i, ts := range mc.ThumbnailSizes {
+		if ts.Width <= 0 || ts.Height <= 0 {
+			return fmt.Errorf("thumbnail_sizes[%d]: bad dimensions %dx%d", i, ts.Width, ts.Height)
+		}
+		if ts.Method != "crop" && ts.Method != "scale" {
+			return fmt.Errorf("thumbnail_sizes[%d]: unknown method %q", i, ts.Method)
+		}
+	}
+	for _, ranges := range []struct {
+		name   string
+		values []string
+	}{
+		{"url_preview_ip_range_blacklist", mc.URLPreviewIPRangeBlacklist},
+		{"url_preview_ip_range_whitelist", mc.URLPreviewIPRangeWhitelist},
+	} {
+		for _, r := range ranges.values {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return fmt.Errorf("%s: %q is not a CIDR range", ranges.name, r)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateRegistrationConfig checks the registration settings in rc.
+// Like Synapse, it refuses open registration without any of reCAPTCHA,
+// third-party ID verification and registration tokens, unless
+// EnableWithoutVerification acknowledges the risk.
+func ValidateRegistrationConfig(rc *RegistrationConfig) error {
+	for _, m := range rc.RequiredThreepids {
+		if m != "email" && m != "msisdn" {
+			return fmt.Errorf("registrations_require_3pid: unknown medium %q", m)
+		}
+	}
+	if (rc.RecaptchaPublicKey == "") != (rc.RecaptchaPrivateKey == "") {
+		return errors.New("recaptcha needs both the public and the private key")
+	}
+	for _, alias := range rc.AutoJoinRooms {
+		if !strings.HasPrefix(alias, "#") || !strings.Contains(alias, ":") {
+			return fmt.Errorf("auto_join_rooms: %q is not a room alias", alias)
+		}
+	}
+	verified := rc.RecaptchaPublicKey != "" || len(rc.RequiredThreepids) > 0 || rc.RequireToken
+	if rc.Enabled && !verified && !rc.EnableWithoutVerification {
+		return errors.New("open registration without verification requires enable_registration_without_verification")
+	}
+	return nil
+}
+
+// ValidateOIDCProviders checks the OpenID Connect providers in providers.
+// IDs must be unique and consist of letters, digits and the characters
+// "._~-"; issuers must be https URLs without query or fragment, and scopes,
+// if given, must include openid.
+func ValidateOIDCProviders(providers []OIDCProviderConfig) error {
+	seen := make(map[string]bool)
+	for i, p := range providers {
+		if !idpIDRegexp.MatchString(p.ID) {
+			return fmt.Errorf("provider %d: invalid idp_id %q", i, p.ID)
+		}
+		if seen[p.ID] {
+			return fmt.Errorf("provider %d: duplicate idp_id %q", i, p.ID)
+		}
+		seen[p.ID] = true
+
+		u, err := url.Parse(p.Issuer)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("provider %q: issuer %q is not an https URL", p.ID, p.Issuer)
+		}
+		if p.ClientID == "" {
+			return fmt.Errorf("provider %q: client_id must not be empty", p.ID)
+		}
+		if len(p.Scopes) > 0 && !containsString(p.Scopes, "openid") {
+			return fmt.Errorf("provider %q: scopes must include openid", p.ID)
+		}
+	}
+	return nil
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// Synapse's limits on idp_id.
+	idpIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,250}$`)
+
+	sizeRegexp     = regexp.MustCompile(`^[0-9]+[KM]?$`)
+	durationRegexp = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w|y)?$`)
+)
+
+// IsSize reports whether s is a size as accepted by Synapse's config
+// parser, e.g. 50M.
+func IsSize(s string) bool {
+	return sizeRegexp.MatchString(s)
+}
+
+// IsDuration reports whether s is a duration as accepted by Synapse's
+// config parser, e.g. 90s, 1h or 7d. A plain number is taken as
+// milliseconds.
+func IsDuration(s string) bool {
+	return durationRegexp.MatchString(s)
+}
+
+// ValidateNotifFrom checks the sender address of emails sent by Synapse.
+// Synapse formats it with Python's % operator, substituting the app name
+// for %(app)s, so it must contain that placeholder and no other
+// conversions; a literal percent sign is written %%.
+func ValidateNotifFrom(s string) error {
+	if s == "" {
+		return errors.New("notif_from must not be empty")
+	}
+	hasApp := false
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		switch rest := s[i+1:]; {
+		case strings.HasPrefix(rest, "%"):
+			i++
+		case strings.HasPrefix(rest, "(app)s"):
+			hasApp = true
+			i += len("(app)s")
+		default:
+			return fmt.Errorf("notif_from: unsupported conversion at offset %d, only %%(app)s is allowed and %% must be doubled", i)
+		}
 	}
-	if c.FormSecret == "" {
-		c.FormSecret = randomString(64)
+	if !hasApp {
+		return errors.New("notif_from must contain the %(app)s placeholder")
 	}
+	return nil
+}
 
-	var b bytes.Buffer
-	if err := homeserverYAMLTemplate.Execute(&b, c); err != nil {
+// GenerateHomeserverYAML outputs a homeserver.yaml using the provided
+// HomeserverConfig.
+func GenerateHomeserverYAML(config *HomeserverConfig) ([]byte, error) {
+	hs, err := NewHomeserver(config)
+	if err != nil {
 		return nil, err
 	}
+	p, err := yaml.Marshal(hs)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.ExtraConfigYAML) == 0 {
+		return p, nil
+	}
 
-	return b.Bytes(), nil
+	return MergeYAML(p, config.ExtraConfigYAML...)
+}
+
+func stringOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// ParsePort parses the port number in s, returning def if s is empty.
+func parsePort(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
 }
 
 // RandomString generates a printable random string of length n using a
 // cryptographically-secure RNG.
-func randomString(n int) string {
+func randomString(n int) (string, error) {
 	scratch := make([]byte, (n+3)/4*3)
-	if _, err := rand.Read(scratch); err != nil {
-		panic(err)
+	if _, err := io.ReadFull(randReader, scratch); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
 	}
 
-	return base64.URLEncoding.EncodeToString(scratch)[:n]
+	return base64.URLEncoding.EncodeToString(scratch)[:n], nil
 }
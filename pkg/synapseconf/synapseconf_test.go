@@ -1,8 +1,14 @@
 package synapseconf
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -73,3 +79,988 @@ func TestGenerateSigningKey(t *testing.T) {
 		t.Errorf("expect key of size %d, got %d", ed25519.SeedSize, len(sk))
 	}
 }
+
+func TestGenerateHomeserverYAMLPostgres(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		PostgresConfig: &PostgresConfig{
+			User:     "matrix",
+			Password: "hunter2",
+			Database: "matrixdb",
+			Host:     "db.example.com",
+		},
+	}
+
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+
+	var db struct {
+		Database struct {
+			Name string            `yaml:"name"`
+			Args map[string]string `yaml:"args"`
+		} `yaml:"database"`
+	}
+	if err := yaml.Unmarshal(p, &db); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+
+	if db.Database.Name != "psycopg2" {
+		t.Errorf("database.name: expect psycopg2, got %q", db.Database.Name)
+	}
+	want := map[string]string{
+		"user":     "matrix",
+		"password": "hunter2",
+		"database": "matrixdb",
+		"host":     "db.example.com",
+		"port":     "5432",
+	}
+	for k, v := range want {
+		if got := db.Database.Args[k]; got != v {
+			t.Errorf("database.args.%s: expect %q, got %q", k, v, got)
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLPublicBaseURL(t *testing.T) {
+	tests := []struct {
+		publicBaseURL string
+		want          string
+	}{
+		{"", "https://example.com/"},
+		{"https://matrix.example.com/", "https://matrix.example.com/"},
+	}
+
+	for _, tt := range tests {
+		c := &HomeserverConfig{
+			ServerName:    "example.com",
+			PublicBaseURL: tt.publicBaseURL,
+		}
+		p, err := GenerateHomeserverYAML(c)
+		if err != nil {
+			t.Fatalf("GenerateHomeserverYAML: %v", err)
+		}
+
+		var conf struct {
+			PublicBaseURL string `yaml:"public_baseurl"`
+		}
+		if err := yaml.Unmarshal(p, &conf); err != nil {
+			t.Fatalf("yaml.Unmarshal: %v", err)
+		}
+		if conf.PublicBaseURL != tt.want {
+			t.Errorf("PublicBaseURL %q: expect public_baseurl %q, got %q",
+				tt.publicBaseURL, tt.want, conf.PublicBaseURL)
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLReplication(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName:                "example.com",
+		ReplicationHost:           "synapse-replication",
+		FederationSenderInstances: []string{"federation-sender"},
+		AppserviceWorker:          "appservice",
+		DisableMediaRepo:          true,
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+
+	var conf struct {
+		Listeners []struct {
+			Port      int    `yaml:"port"`
+			Type      string `yaml:"type"`
+			Resources []struct {
+				Names []string `yaml:"names"`
+			} `yaml:"resources"`
+		} `yaml:"listeners"`
+		InstanceMap map[string]struct {
+			Host string `yaml:"host"`
+			Port int    `yaml:"port"`
+		} `yaml:"instance_map"`
+		FederationSenderInstances   []string `yaml:"federation_sender_instances"`
+		PusherInstances             []string `yaml:"pusher_instances"`
+		NotifyAppservicesFromWorker string   `yaml:"notify_appservices_from_worker"`
+		EnableMediaRepo             *bool    `yaml:"enable_media_repo"`
+		SendFederation              *bool    `yaml:"send_federation"`
+	}
+	if err := yaml.Unmarshal(p, &conf); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+
+	var replication bool
+	for _, l := range conf.Listeners {
+		if l.Port == ReplicationHTTPPort && l.Type == "http" &&
+			len(l.Resources) == 1 && strings.Join(l.Resources[0].Names, ",") == "replication" {
+			replication = true
+		}
+		if l.Type == "replication" {
+			t.Errorf("unexpected TCP replication listener on port %d", l.Port)
+		}
+	}
+	if !replication {
+		t.Errorf("expect HTTP replication listener on port %d, got %+v", ReplicationHTTPPort, conf.Listeners)
+	}
+	if main := conf.InstanceMap["main"]; main.Host != c.ReplicationHost || main.Port != ReplicationHTTPPort {
+		t.Errorf("expect instance_map main at %s:%d, got %+v", c.ReplicationHost, ReplicationHTTPPort, main)
+	}
+	if strings.Join(conf.FederationSenderInstances, ",") != "federation-sender" {
+		t.Errorf("expect federation_sender_instances [federation-sender], got %v", conf.FederationSenderInstances)
+	}
+	if conf.NotifyAppservicesFromWorker != "appservice" {
+		t.Errorf("expect notify_appservices_from_worker appservice, got %q", conf.NotifyAppservicesFromWorker)
+	}
+	if conf.EnableMediaRepo == nil || *conf.EnableMediaRepo {
+		t.Errorf("expect enable_media_repo: False, got %v", conf.EnableMediaRepo)
+	}
+	if conf.PusherInstances != nil || conf.SendFederation != nil {
+		t.Errorf("expect pusher_instances and send_federation to be unset, got %v and %v",
+			conf.PusherInstances, conf.SendFederation)
+	}
+}
+
+func TestGenerateWorkerYAML(t *testing.T) {
+	tests := []struct {
+		resources []string
+		mediaRepo bool
+		listeners int
+	}{
+		{nil, false, 0},
+		{[]string{"client", "federation"}, false, 1},
+		{[]string{"media"}, true, 1},
+	}
+
+	for _, tt := range tests {
+		c := &WorkerConfig{
+			App:       "synapse.app.generic_worker",
+			Resources: tt.resources,
+			MediaRepo: tt.mediaRepo,
+		}
+		p, err := GenerateWorkerYAML(c)
+		if err != nil {
+			t.Fatalf("GenerateWorkerYAML: %v", err)
+		}
+
+		var conf struct {
+			App             string `yaml:"worker_app"`
+			ReplicationHost string `yaml:"worker_replication_host"`
+			Listeners       []struct {
+				Resources []struct {
+					Names []string `yaml:"names"`
+				} `yaml:"resources"`
+			} `yaml:"worker_listeners"`
+			EnableMediaRepo *bool `yaml:"enable_media_repo"`
+		}
+		if err := yaml.Unmarshal(p, &conf); err != nil {
+			t.Fatalf("yaml.Unmarshal: %v", err)
+		}
+
+		if conf.App != c.App {
+			t.Errorf("expect worker_app %q, got %q", c.App, conf.App)
+		}
+		if conf.ReplicationHost != "" {
+			t.Errorf("expect no worker_replication_host, got %q", conf.ReplicationHost)
+		}
+		if got := conf.EnableMediaRepo != nil && *conf.EnableMediaRepo; got != tt.mediaRepo {
+			t.Errorf("resources %v: expect enable_media_repo %t, got %v", tt.resources, tt.mediaRepo, conf.EnableMediaRepo)
+		}
+		if len(conf.Listeners) != tt.listeners {
+			t.Fatalf("resources %v: expect %d listeners, got %d", tt.resources, tt.listeners, len(conf.Listeners))
+		}
+		if tt.listeners > 0 {
+			got := conf.Listeners[0].Resources[0].Names
+			if strings.Join(got, ",") != strings.Join(tt.resources, ",") {
+				t.Errorf("expect listener resources %v, got %v", tt.resources, got)
+			}
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLRedis(t *testing.T) {
+	tests := []struct {
+		redis *RedisConfig
+		want  map[string]interface{}
+	}{
+		{nil, nil},
+		{
+			&RedisConfig{Host: "redis.example.com"},
+			map[string]interface{}{
+				"enabled": true,
+				"host":    "redis.example.com",
+				"port":    6379,
+			},
+		},
+		{
+			&RedisConfig{Host: "redis", Port: "6380", Password: "hunter2"},
+			map[string]interface{}{
+				"enabled":  true,
+				"host":     "redis",
+				"port":     6380,
+				"password": "hunter2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		c := &HomeserverConfig{
+			ServerName:  "example.com",
+			RedisConfig: tt.redis,
+		}
+		p, err := GenerateHomeserverYAML(c)
+		if err != nil {
+			t.Fatalf("GenerateHomeserverYAML: %v", err)
+		}
+
+		var conf struct {
+			Redis map[string]interface{} `yaml:"redis"`
+		}
+		if err := yaml.Unmarshal(p, &conf); err != nil {
+			t.Fatalf("yaml.Unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(conf.Redis, tt.want) {
+			t.Errorf("RedisConfig %+v: expect redis %v, got %v", tt.redis, tt.want, conf.Redis)
+		}
+	}
+}
+
+func TestMergeYAML(t *testing.T) {
+	base := []byte(`
+server_name: example.com
+database:
+  name: psycopg2
+  args:
+    user: synapse
+    cp_min: 5
+federation_ip_range_blacklist:
+  - 127.0.0.0/8
+`)
+	override := []byte(`
+database:
+  args:
+    cp_min: 10
+    cp_max: 20
+federation_ip_range_blacklist:
+  - 10.0.0.0/8
+enable_registration: true
+`)
+
+	p, err := MergeYAML(base, override)
+	if err != nil {
+		t.Fatalf("MergeYAML: %v", err)
+	}
+	want := `server_name: example.com
+database:
+  name: psycopg2
+  args:
+    user: synapse
+    cp_min: 10
+    cp_max: 20
+federation_ip_range_blacklist:
+- 10.0.0.0/8
+enable_registration: true
+`
+	if string(p) != want {
+		t.Errorf("expect\n%s\ngot\n%s", want, p)
+	}
+
+	if _, err := MergeYAML(base, []byte("- not a mapping\n")); err == nil {
+		t.Error("sequence override: expect error, got nil")
+	}
+}
+
+func TestGenerateHomeserverYAMLExtraConfig(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		ExtraConfigYAML: [][]byte{
+			[]byte("report_stats: true\nenable_registration: true\n"),
+			[]byte("enable_registration: false\n"),
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+
+	var conf struct {
+		ServerName         string `yaml:"server_name"`
+		ReportStats        bool   `yaml:"report_stats"`
+		EnableRegistration *bool  `yaml:"enable_registration"`
+	}
+	if err := yaml.Unmarshal(p, &conf); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+	// Duplicate keys are an error for yaml.UnmarshalStrict.
+	var m yaml.MapSlice
+	if err := yaml.UnmarshalStrict(p, &m); err != nil {
+		t.Errorf("yaml.UnmarshalStrict: %v", err)
+	}
+	if conf.ServerName != "example.com" || !conf.ReportStats {
+		t.Errorf("expect server_name example.com and report_stats true, got %q and %t",
+			conf.ServerName, conf.ReportStats)
+	}
+	if conf.EnableRegistration == nil || *conf.EnableRegistration {
+		t.Errorf("expect later override to win: enable_registration false, got %v", conf.EnableRegistration)
+	}
+}
+
+func TestMergeYAMLNullRemovesKey(t *testing.T) {
+	base := []byte("server_name: example.com\nweb_client_location: https://riot.example.com/\nredis:\n  enabled: true\n  host: redis\n")
+	override := []byte("web_client_location: null\nredis:\n  host: ~\nno_such_key: null\n")
+
+	p, err := MergeYAML(base, override)
+	if err != nil {
+		t.Fatalf("MergeYAML: %v", err)
+	}
+	want := "server_name: example.com\nredis:\n  enabled: true\n"
+	if string(p) != want {
+		t.Errorf("expect\n%s\ngot\n%s", want, p)
+	}
+}
+
+func TestMergeYAMLKeyedLists(t *testing.T) {
+	base := []byte(`
+listeners:
+  - port: 8008
+    type: http
+    x_forwarded: true
+  - port: 9092
+    type: replication
+trusted_key_servers:
+  - server_name: matrix.org
+`)
+	override := []byte(`
+listeners:
+  - port: 8008
+    x_forwarded: false
+  - port: 9000
+    type: metrics
+trusted_key_servers:
+  - server_name: matrix.org
+    accept_keys_insecurely: true
+  - server_name: example.org
+`)
+
+	p, err := MergeYAML(base, override)
+	if err != nil {
+		t.Fatalf("MergeYAML: %v", err)
+	}
+	want := `listeners:
+- port: 8008
+  type: http
+  x_forwarded: false
+- port: 9092
+  type: replication
+- port: 9000
+  type: metrics
+trusted_key_servers:
+- server_name: matrix.org
+  accept_keys_insecurely: true
+- server_name: example.org
+`
+	if string(p) != want {
+		t.Errorf("expect\n%s\ngot\n%s", want, p)
+	}
+}
+
+// TestGenerateHomeserverYAMLEscaping ensures values containing YAML
+// metacharacters survive a round trip unchanged.
+func TestGenerateHomeserverYAMLEscaping(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName:   "example.com",
+		AdminContact: `mailto:"admin"@example.com`,
+		PostgresConfig: &PostgresConfig{
+			Host:     "db",
+			Password: "p\"a: s#s\n'w{o}r[d]",
+		},
+		RedisConfig: &RedisConfig{
+			Host:     "redis",
+			Password: "- *&!%@`",
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	if hs.AdminContact != c.AdminContact {
+		t.Errorf("admin_contact: expect %q, got %q", c.AdminContact, hs.AdminContact)
+	}
+	if hs.Database.Args.Password != c.PostgresConfig.Password {
+		t.Errorf("database password: expect %q, got %q", c.PostgresConfig.Password, hs.Database.Args.Password)
+	}
+	if hs.Redis == nil || hs.Redis.Password != c.RedisConfig.Password {
+		t.Errorf("redis password: expect %q, got %+v", c.RedisConfig.Password, hs.Redis)
+	}
+}
+
+func TestGenerateHomeserverYAMLInvalidPort(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName:     "example.com",
+		PostgresConfig: &PostgresConfig{Host: "db", Port: "5432x"},
+	}
+	if _, err := GenerateHomeserverYAML(c); err == nil {
+		t.Error("expect error for invalid postgres port, got nil")
+	}
+}
+
+func TestGenerateHomeserverYAMLFromTemplate(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		PostgresConfig: &PostgresConfig{
+			Host:     "db",
+			Password: `pa"ss`,
+		},
+		ExtraConfigYAML: [][]byte{[]byte("enable_registration: true\n")},
+	}
+	text := `server_name: {{ .ServerName | quote }}
+public_baseurl: {{ .PublicBaseURL | default (printf "https://%s/" .ServerName) }}
+database:
+  name: psycopg2
+  args: {{- dict "host" .PostgresConfig.Host "password" .PostgresConfig.Password "port" (.PostgresConfig.Port | default "5432" | atoi) | toYaml | nindent 4 }}
+turn_shared_secret: {{ secret "turn" "secret" | squote }}
+`
+	secret := func(name, key string) (string, error) {
+		if name != "turn" || key != "secret" {
+			return "", fmt.Errorf("no key %q in secret %q", key, name)
+		}
+		return "it's", nil
+	}
+	p, err := GenerateHomeserverYAMLFromTemplate(text, c, secret)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAMLFromTemplate: %v", err)
+	}
+	want := `server_name: example.com
+public_baseurl: https://example.com/
+database:
+  name: psycopg2
+  args:
+    host: db
+    password: pa"ss
+    port: 5432
+turn_shared_secret: it's
+enable_registration: true
+`
+	if string(p) != want {
+		t.Errorf("expect\n%s\ngot\n%s", want, p)
+	}
+
+	errTests := []struct {
+		name string
+		text string
+	}{
+		{"parse", "server_name: {{ .ServerName"},
+		{"unknown field", "server_name: {{ .NoSuchField }}"},
+		{"required", `admin_contact: {{ required "need admin contact" .AdminContact }}`},
+		{"secret", `turn_shared_secret: {{ secret "turn" "other" }}`},
+		{"not a mapping", "- {{ .ServerName }}"},
+	}
+	for _, tt := range errTests {
+		if _, err := GenerateHomeserverYAMLFromTemplate(tt.text, c, secret); err == nil {
+			t.Errorf("%s: expect error, got nil", tt.name)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy exhausted")
+}
+
+// TestFailingRNG ensures that RNG failures are reported as errors rather
+// than panics.
+func TestFailingRNG(t *testing.T) {
+	defer func(r io.Reader) { randReader = r }(randReader)
+	randReader = failingReader{}
+
+	if _, err := GenerateSigningKey("a_abcd"); err == nil {
+		t.Error("GenerateSigningKey: expect error, got nil")
+	}
+	if _, err := GenerateHomeserverYAML(&HomeserverConfig{ServerName: "example.com"}); err == nil {
+		t.Error("GenerateHomeserverYAML without secrets: expect error, got nil")
+	}
+	c := &HomeserverConfig{
+		ServerName:               "example.com",
+		RegistrationSharedSecret: "a",
+		MacaroonSecretKey:        "b",
+		FormSecret:               "c",
+	}
+	if _, err := GenerateHomeserverYAML(c); err != nil {
+		t.Errorf("GenerateHomeserverYAML with secrets: %v", err)
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	// Test vector from RFC 8032, section 7.1.
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	pub, _ := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+
+	file := FormatSigningKeys(SigningKey{Version: "a_abcd", Seed: seed})
+	keys, err := ParseSigningKeys(append([]byte("\n"), file...))
+	if err != nil {
+		t.Fatalf("ParseSigningKeys: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Version != "a_abcd" || !bytes.Equal(keys[0].Seed, seed) {
+		t.Fatalf("expect key a_abcd with seed %x, got %+v", seed, keys)
+	}
+	if id := keys[0].KeyID(); id != "ed25519:a_abcd" {
+		t.Errorf("expect key ID ed25519:a_abcd, got %q", id)
+	}
+	vk, err := keys[0].VerifyKey()
+	if err != nil {
+		t.Fatalf("VerifyKey: %v", err)
+	}
+	if want := base64.RawStdEncoding.EncodeToString(pub); vk != want {
+		t.Errorf("expect verify key %s, got %s", want, vk)
+	}
+
+	for _, bad := range []string{
+		"",
+		"ed25519 a_abcd\n",
+		"rsa a_abcd " + base64.RawStdEncoding.EncodeToString(seed) + "\n",
+		"ed25519 a_abcd not*base64\n",
+		"ed25519 a_abcd " + base64.RawStdEncoding.EncodeToString(seed[:16]) + "\n",
+	} {
+		if _, err := ParseSigningKeys([]byte(bad)); err == nil {
+			t.Errorf("%q: expect error, got nil", bad)
+		}
+	}
+}
+
+func TestOldSigningKeys(t *testing.T) {
+	old := map[string]OldSigningKey{
+		"ed25519:a_abcd": {Key: "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo", ExpiredTS: 1600000000000},
+	}
+	p, err := FormatOldSigningKeys(old)
+	if err != nil {
+		t.Fatalf("FormatOldSigningKeys: %v", err)
+	}
+	got, err := ParseOldSigningKeys(p)
+	if err != nil {
+		t.Fatalf("ParseOldSigningKeys: %v", err)
+	}
+	if !reflect.DeepEqual(got, old) {
+		t.Errorf("expect %v, got %v", old, got)
+	}
+	if _, err := ParseOldSigningKeys([]byte("rsa:x: {key: abc, expired_ts: 1}\n")); err == nil {
+		t.Error("unsupported algorithm: expect error, got nil")
+	}
+
+	hs, err := GenerateHomeserverYAML(&HomeserverConfig{
+		ServerName:     "example.com",
+		OldSigningKeys: old,
+	})
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var conf struct {
+		OldSigningKeys map[string]OldSigningKey `yaml:"old_signing_keys"`
+	}
+	if err := yaml.Unmarshal(hs, &conf); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(conf.OldSigningKeys, old) {
+		t.Errorf("old_signing_keys: expect %v, got %v", old, conf.OldSigningKeys)
+	}
+}
+
+func TestGenerateHomeserverYAMLEmail(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		EmailConfig: &EmailConfig{
+			SMTPHost:  "smtp.example.com",
+			SMTPUser:  "synapse",
+			SMTPPass:  `pa"ss`,
+			ForceTLS:  true,
+			NotifFrom: "Your Friendly %(app)s homeserver <noreply@example.com>",
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	want := &Email{
+		SMTPHost:  "smtp.example.com",
+		SMTPPort:  465,
+		SMTPUser:  "synapse",
+		SMTPPass:  `pa"ss`,
+		ForceTLS:  true,
+		NotifFrom: "Your Friendly %(app)s homeserver <noreply@example.com>",
+	}
+	if !reflect.DeepEqual(hs.Email, want) {
+		t.Errorf("expect email %+v, got %+v", want, hs.Email)
+	}
+
+	c.EmailConfig.NotifFrom = "noreply@example.com"
+	if _, err := GenerateHomeserverYAML(c); err == nil {
+		t.Error("notif_from without placeholder: expect error, got nil")
+	}
+}
+
+func TestValidateNotifFrom(t *testing.T) {
+	tests := []struct {
+		s  string
+		ok bool
+	}{
+		{"%(app)s <noreply@example.com>", true},
+		{"100%% %(app)s <noreply@example.com>", true},
+		{"", false},
+		{"noreply@example.com", false},
+		{"%(app)s at 100% <noreply@example.com>", false},
+		{"%(server)s <noreply@example.com>", false},
+		{"%(app)s %", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateNotifFrom(tt.s); (err == nil) != tt.ok {
+			t.Errorf("%q: expect ok %t, got error %v", tt.s, tt.ok, err)
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLTurn(t *testing.T) {
+	allowGuests := false
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		TurnConfig: &TurnConfig{
+			URIs:         []string{"turn:turn.example.com:3478?transport=udp"},
+			SharedSecret: "s3cret",
+			UserLifetime: "1h",
+			AllowGuests:  &allowGuests,
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	if !reflect.DeepEqual(hs.TurnURIs, c.TurnConfig.URIs) {
+		t.Errorf("expect turn_uris %q, got %q", c.TurnConfig.URIs, hs.TurnURIs)
+	}
+	if hs.TurnSharedSecret != "s3cret" {
+		t.Errorf("expect turn_shared_secret %q, got %q", "s3cret", hs.TurnSharedSecret)
+	}
+	if hs.TurnUserLifetime != "1h" {
+		t.Errorf("expect turn_user_lifetime %q, got %q", "1h", hs.TurnUserLifetime)
+	}
+	if hs.TurnAllowGuests == nil || *hs.TurnAllowGuests {
+		t.Errorf("expect turn_allow_guests false, got %v", hs.TurnAllowGuests)
+	}
+
+	c.TurnConfig.URIs = nil
+	if _, err := GenerateHomeserverYAML(c); err == nil {
+		t.Error("no TURN URIs: expect error, got nil")
+	}
+}
+
+func TestGenerateCoturnConfig(t *testing.T) {
+	p, err := GenerateCoturnConfig(&CoturnConfig{
+		Realm:        "example.com",
+		MinRelayPort: 49160,
+		MaxRelayPort: 49199,
+	})
+	if err != nil {
+		t.Fatalf("GenerateCoturnConfig: %v", err)
+	}
+	conf := string(p)
+	for _, line := range []string{
+		"listening-port=3478\n",
+		"min-port=49160\n",
+		"max-port=49199\n",
+		"realm=example.com\n",
+		"use-auth-secret\n",
+		"denied-peer-ip=10.0.0.0-10.255.255.255\n",
+	} {
+		if !strings.Contains(conf, line) {
+			t.Errorf("expect line %q in:\n%s", line, conf)
+		}
+	}
+	if strings.Contains(conf, "static-auth-secret") {
+		t.Errorf("shared secret must not be part of the config file:\n%s", conf)
+	}
+
+	for _, c := range []*CoturnConfig{
+		{Realm: "", MinRelayPort: 49160, MaxRelayPort: 49199},
+		{Realm: "example.com\nno-auth", MinRelayPort: 49160, MaxRelayPort: 49199},
+		{Realm: "example.com", MinRelayPort: 49199, MaxRelayPort: 49160},
+		{Realm: "example.com"},
+	} {
+		if _, err := GenerateCoturnConfig(c); err == nil {
+			t.Errorf("%+v: expect error, got nil", c)
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLS3Storage(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		S3StorageConfig: &S3StorageConfig{
+			Bucket:          "media",
+			EndpointURL:     "http://minio:9000",
+			AccessKeyID:     "minio",
+			SecretAccessKey: "minio123",
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	want := []MediaStorageProvider{{
+		Module:           S3StorageProviderModule,
+		StoreLocal:       true,
+		StoreRemote:      true,
+		StoreSynchronous: true,
+		Config: map[string]string{
+			"bucket":            "media",
+			"endpoint_url":      "http://minio:9000",
+			"access_key_id":     "minio",
+			"secret_access_key": "minio123",
+		},
+	}}
+	if !reflect.DeepEqual(hs.MediaStorageProviders, want) {
+		t.Errorf("expect media storage providers %+v, got %+v", want, hs.MediaStorageProviders)
+	}
+
+	c.S3StorageConfig.Bucket = ""
+	if _, err := GenerateHomeserverYAML(c); err == nil {
+		t.Error("empty bucket: expect error, got nil")
+	}
+}
+
+func TestGenerateHomeserverYAMLMedia(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		MediaConfig: &MediaConfig{
+			MaxUploadSize:       "100M",
+			RemoteMediaLifetime: "90d",
+			ThumbnailSizes:      []ThumbnailSize{{Width: 32, Height: 32, Method: "crop"}},
+			URLPreviewEnabled:   true,
+			MaxSpiderSize:       "10M",
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	if hs.MaxUploadSize != "100M" {
+		t.Errorf("expect max_upload_size 100M, got %q", hs.MaxUploadSize)
+	}
+	if want := (&MediaRetention{RemoteMediaLifetime: "90d"}); !reflect.DeepEqual(hs.MediaRetention, want) {
+		t.Errorf("expect media_retention %+v, got %+v", want, hs.MediaRetention)
+	}
+	if !reflect.DeepEqual(hs.ThumbnailSizes, c.MediaConfig.ThumbnailSizes) {
+		t.Errorf("expect thumbnail_sizes %+v, got %+v", c.MediaConfig.ThumbnailSizes, hs.ThumbnailSizes)
+	}
+	if !hs.URLPreviewEnabled {
+		t.Error("expect url_preview_enabled")
+	}
+	// Synapse refuses to enable previews without a blacklist.
+	if !reflect.DeepEqual(hs.URLPreviewIPRangeBlacklist, DefaultFederationIPRangeBlacklist) {
+		t.Errorf("expect default url_preview_ip_range_blacklist, got %q", hs.URLPreviewIPRangeBlacklist)
+	}
+
+	c.MediaConfig.URLPreviewEnabled = false
+	p, err = GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	if bytes.Contains(p, []byte("url_preview")) || bytes.Contains(p, []byte("max_spider_size")) {
+		t.Errorf("previews disabled: expect no preview settings in:\n%s", p)
+	}
+}
+
+func TestValidateMediaConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		mc   MediaConfig
+		ok   bool
+	}{
+		{"empty", MediaConfig{}, true},
+		{"sizes", MediaConfig{MaxUploadSize: "512K", MaxSpiderSize: "1048576"}, true},
+		{"size unit", MediaConfig{MaxUploadSize: "1G"}, false},
+		{"lifetime", MediaConfig{LocalMediaLifetime: "4w", RemoteMediaLifetime: "1y"}, true},
+		{"lifetime unit", MediaConfig{LocalMediaLifetime: "4 weeks"}, false},
+		{"thumbnail", MediaConfig{ThumbnailSizes: []ThumbnailSize{{32, 32, "scale"}}}, true},
+		{"thumbnail method", MediaConfig{ThumbnailSizes: []ThumbnailSize{{32, 32, "stretch"}}}, false},
+		{"thumbnail size", MediaConfig{ThumbnailSizes: []ThumbnailSize{{0, 32, "crop"}}}, false},
+		{"ranges", MediaConfig{URLPreviewIPRangeBlacklist: []string{"10.0.0.0/8", "fc00::/7"}}, true},
+		{"bad range", MediaConfig{URLPreviewIPRangeWhitelist: []string{"10.0.0.1"}}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateMediaConfig(&tt.mc); (err == nil) != tt.ok {
+			t.Errorf("%s: expect ok %t, got error %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLRegistration(t *testing.T) {
+	c := &HomeserverConfig{
+		ServerName: "example.com",
+		RegistrationConfig: &RegistrationConfig{
+			Enabled:             true,
+			RequiredThreepids:   []string{"email"},
+			AutoJoinRooms:       []string{"#welcome:example.com"},
+			RecaptchaPublicKey:  "public",
+			RecaptchaPrivateKey: "private",
+		},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	if !hs.EnableRegistration || hs.EnableRegistrationWithoutVerification {
+		t.Errorf("expect verified registration, got enable_registration %t, enable_registration_without_verification %t",
+			hs.EnableRegistration, hs.EnableRegistrationWithoutVerification)
+	}
+	if !reflect.DeepEqual(hs.RegistrationsRequire3PID, []string{"email"}) {
+		t.Errorf("expect registrations_require_3pid [email], got %q", hs.RegistrationsRequire3PID)
+	}
+	if !reflect.DeepEqual(hs.AutoJoinRooms, []string{"#welcome:example.com"}) {
+		t.Errorf("expect auto_join_rooms [#welcome:example.com], got %q", hs.AutoJoinRooms)
+	}
+	if !hs.EnableRegistrationCaptcha || hs.RecaptchaPublicKey != "public" || hs.RecaptchaPrivateKey != "private" {
+		t.Errorf("expect reCAPTCHA enabled with keys, got %t %q %q",
+			hs.EnableRegistrationCaptcha, hs.RecaptchaPublicKey, hs.RecaptchaPrivateKey)
+	}
+}
+
+func TestValidateRegistrationConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		rc   RegistrationConfig
+		ok   bool
+	}{
+		{"closed", RegistrationConfig{}, true},
+		{"open", RegistrationConfig{Enabled: true}, false},
+		{"open acknowledged", RegistrationConfig{Enabled: true, EnableWithoutVerification: true}, true},
+		{"token", RegistrationConfig{Enabled: true, RequireToken: true}, true},
+		{"msisdn", RegistrationConfig{Enabled: true, RequiredThreepids: []string{"msisdn"}}, true},
+		{"unknown medium", RegistrationConfig{RequiredThreepids: []string{"fax"}}, false},
+		{"captcha", RegistrationConfig{Enabled: true, RecaptchaPublicKey: "a", RecaptchaPrivateKey: "b"}, true},
+		{"captcha without private key", RegistrationConfig{Enabled: true, RecaptchaPublicKey: "a"}, false},
+		{"room ID", RegistrationConfig{AutoJoinRooms: []string{"!abc:example.com"}}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateRegistrationConfig(&tt.rc); (err == nil) != tt.ok {
+			t.Errorf("%s: expect ok %t, got error %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestGenerateHomeserverYAMLOIDCProviders(t *testing.T) {
+	provider := OIDCProviderConfig{
+		ID:                  "keycloak",
+		Name:                `Example "SSO": Keycloak`,
+		Issuer:              "https://keycloak.example.com/realms/example",
+		ClientID:            "synapse",
+		ClientSecret:        "s3cret: #1",
+		Scopes:              []string{"openid", "profile"},
+		LocalpartTemplate:   "{{ user.preferred_username }}",
+		DisplayNameTemplate: "{{ user.given_name }} {{ user.family_name }}",
+	}
+	c := &HomeserverConfig{
+		ServerName:    "example.com",
+		OIDCProviders: []OIDCProviderConfig{provider},
+	}
+	p, err := GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var hs Homeserver
+	if err := yaml.UnmarshalStrict(p, &hs); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict: %v", err)
+	}
+	want := []OIDCProvider{{
+		IdpID:        "keycloak",
+		IdpName:      `Example "SSO": Keycloak`,
+		Issuer:       "https://keycloak.example.com/realms/example",
+		ClientID:     "synapse",
+		ClientSecret: "s3cret: #1",
+		Scopes:       []string{"openid", "profile"},
+		UserMappingProvider: &OIDCUserMappingProvider{
+			Config: OIDCUserMappingConfig{
+				LocalpartTemplate:   "{{ user.preferred_username }}",
+				DisplayNameTemplate: "{{ user.given_name }} {{ user.family_name }}",
+			},
+		},
+	}}
+	if !reflect.DeepEqual(hs.OIDCProviders, want) {
+		t.Errorf("expect oidc_providers %+v, got %+v", want, hs.OIDCProviders)
+	}
+
+	// Overrides are merged into the provider with the same idp_id.
+	c.ExtraConfigYAML = [][]byte{[]byte("oidc_providers:\n- idp_id: keycloak\n  allow_existing_users: true\n")}
+	p, err = GenerateHomeserverYAML(c)
+	if err != nil {
+		t.Fatalf("GenerateHomeserverYAML: %v", err)
+	}
+	var merged struct {
+		OIDCProviders []map[string]interface{} `yaml:"oidc_providers"`
+	}
+	if err := yaml.Unmarshal(p, &merged); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+	if n := len(merged.OIDCProviders); n != 1 {
+		t.Fatalf("expect 1 merged provider, got %d", n)
+	}
+	if got := merged.OIDCProviders[0]; got["allow_existing_users"] != true || got["client_id"] != "synapse" {
+		t.Errorf("expect override merged into provider, got %v", got)
+	}
+}
+
+func TestValidateOIDCProviders(t *testing.T) {
+	valid := OIDCProviderConfig{
+		ID:       "keycloak",
+		Issuer:   "https://keycloak.example.com/realms/example",
+		ClientID: "synapse",
+	}
+	tests := []struct {
+		name   string
+		modify func(p *OIDCProviderConfig)
+		ok     bool
+	}{
+		{"valid", func(p *OIDCProviderConfig) {}, true},
+		{"empty ID", func(p *OIDCProviderConfig) { p.ID = "" }, false},
+		{"bad ID", func(p *OIDCProviderConfig) { p.ID = "key cloak" }, false},
+		{"http issuer", func(p *OIDCProviderConfig) { p.Issuer = "http://keycloak.example.com/" }, false},
+		{"relative issuer", func(p *OIDCProviderConfig) { p.Issuer = "keycloak.example.com" }, false},
+		{"issuer with query", func(p *OIDCProviderConfig) { p.Issuer += "?x=1" }, false},
+		{"no client ID", func(p *OIDCProviderConfig) { p.ClientID = "" }, false},
+		{"scopes without openid", func(p *OIDCProviderConfig) { p.Scopes = []string{"profile"} }, false},
+	}
+	for _, tt := range tests {
+		p := valid
+		tt.modify(&p)
+		if err := ValidateOIDCProviders([]OIDCProviderConfig{p}); (err == nil) != tt.ok {
+			t.Errorf("%s: expect ok %t, got error %v", tt.name, tt.ok, err)
+		}
+	}
+
+	if err := ValidateOIDCProviders([]OIDCProviderConfig{valid, valid}); err == nil {
+		t.Error("duplicate idp_id: expect error, got nil")
+	}
+}
@@ -0,0 +1,237 @@
+package synapseconf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A SecretFunc returns the value stored under key in the named Secret.
+type SecretFunc func(name, key string) (string, error)
+
+// ParseHomeserverTemplate parses text as a homeserver.yaml template. Besides
+// the text/template builtins, templates may use the functions returned by
+// TemplateFuncs and
+//
+//	secret NAME KEY
+//
+// returning the value stored under KEY in the Secret NAME.
+func ParseHomeserverTemplate(text string) (*template.Template, error) {
+	return template.New("homeserver.yaml").
+		Option("missingkey=error").
+		Funcs(TemplateFuncs()).
+		Funcs(template.FuncMap{"secret": noSecrets}).
+		Parse(text)
+}
+
+// GenerateHomeserverYAMLFromTemplate outputs a homeserver.yaml by executing
+// the template in text with config as data. Calls to the template function
+// secret are served by secret, which may be nil if there are no Secrets to
+// access. The documents in config.ExtraConfigYAML are merged on top of the
+// result, which must be a YAML mapping.
+func GenerateHomeserverYAMLFromTemplate(text string, config *HomeserverConfig, secret SecretFunc) ([]byte, error) {
+	t, err := ParseHomeserverTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		t.Funcs(template.FuncMap{"secret": secret})
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, config); err != nil {
+		return nil, err
+	}
+	p, err := MergeYAML(b.Bytes(), config.ExtraConfigYAML...)
+	if err != nil {
+		return nil, fmt.Errorf("template output: %w", err)
+	}
+	return p, nil
+}
+
+func noSecrets(name, key string) (string, error) {
+	return "", errors.New("no secrets available")
+}
+
+// TemplateFuncs returns the helper functions available to homeserver.yaml
+// templates. They are named after and behave like their counterparts in
+// the sprig library used by Helm:
+//
+//	default DEFAULT VALUE        VALUE, or DEFAULT if VALUE is empty
+//	empty VALUE                  whether VALUE is the zero value of its type
+//	coalesce VALUE...            the first non-empty VALUE
+//	ternary TRUE FALSE COND      TRUE if COND holds, FALSE otherwise
+//	required MSG VALUE           VALUE, failing with MSG if it is empty
+//	quote, squote                double- or single-quoted string
+//	upper, lower, trim           string case and whitespace handling
+//	trimPrefix, trimSuffix       remove a prefix or suffix
+//	replace OLD NEW S            replace all occurrences of OLD in S
+//	contains, hasPrefix,         substring tests, with the string to search
+//	hasSuffix SUBSTR S           in last
+//	join SEP LIST, split SEP S   join or split strings
+//	indent N S, nindent N S      indent each line of S, nindent adds a
+//	                             leading newline
+//	toYaml, toJson VALUE         VALUE encoded as YAML or JSON
+//	b64enc, b64dec, sha256sum    encodings and hashes of strings
+//	atoi S                       S converted to an integer
+//	list VALUE...                a list of the arguments
+//	dict KEY VALUE...            a map built from key/value pairs
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"default":  defaultValue,
+		"empty":    isEmpty,
+		"coalesce": coalesce,
+		"ternary":  ternary,
+		"required": required,
+
+		"quote":      func(s interface{}) string { return fmt.Sprintf("%q", toString(s)) },
+		"squote":     func(s interface{}) string { return "'" + strings.ReplaceAll(toString(s), "'", "''") + "'" },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"join":       join,
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"indent":     indent,
+		"nindent":    func(n int, s string) string { return "\n" + indent(n, s) },
+
+		"toYaml":    toYAML,
+		"toJson":    toJSON,
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":    b64dec,
+		"sha256sum": func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) },
+
+		"atoi": strconv.Atoi,
+		"list": func(v ...interface{}) []interface{} { return v },
+		"dict": dict,
+	}
+}
+
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
+
+func defaultValue(def, v interface{}) interface{} {
+	if isEmpty(v) {
+		return def
+	}
+	return v
+}
+
+func coalesce(v ...interface{}) interface{} {
+	for _, x := range v {
+		if !isEmpty(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func ternary(t, f interface{}, cond bool) interface{} {
+	if cond {
+		return t
+	}
+	return f
+}
+
+func required(msg string, v interface{}) (interface{}, error) {
+	if isEmpty(v) {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func join(sep string, v interface{}) (string, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected list, got %T", v)
+	}
+	a := make([]string, rv.Len())
+	for i := range a {
+		a[i] = toString(rv.Index(i).Interface())
+	}
+	return strings.Join(a, sep), nil
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func toYAML(v interface{}) (string, error) {
+	p, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(p), "\n"), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+func b64dec(s string) (string, error) {
+	p, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+func dict(kv ...interface{}) (map[string]interface{}, error) {
+	if len(kv)%2 != 0 {
+		return nil, errors.New("dict: odd number of arguments")
+	}
+	m := make(map[string]interface{}, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		k, ok := kv[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is not a string", kv[i])
+		}
+		m[k] = kv[i+1]
+	}
+	return m, nil
+}
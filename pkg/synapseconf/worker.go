@@ -0,0 +1,52 @@
+package synapseconf
+
+import (
+	"gopkg.in/yaml.v2"
+)
+
+// ReplicationHTTPPort is the port the main process serves HTTP replication
+// requests from workers on. The processes exchange replication streams
+// through Redis.
+const ReplicationHTTPPort = 9093
+
+// A WorkerConfig describes a Synapse worker process. It complements the
+// homeserver.yaml shared with the main process.
+type WorkerConfig struct {
+	// worker application, e.g. synapse.app.generic_worker
+	App string
+	// resources served on the worker's HTTP listener (e.g. client,
+	// federation, media). No listener is configured if empty.
+	Resources []string
+	// whether the worker serves the media repository
+	MediaRepo bool
+}
+
+// NewWorker returns the worker config file model for the provided
+// WorkerConfig.
+func NewWorker(config *WorkerConfig) *Worker {
+	w := &Worker{
+		App:       config.App,
+		LogConfig: "/data/homeserver.log.config",
+	}
+	if config.MediaRepo {
+		enabled := true
+		w.EnableMediaRepo = &enabled
+	}
+	if len(config.Resources) > 0 {
+		w.Listeners = []Listener{{
+			Port:       8008,
+			Type:       "http",
+			XForwarded: true,
+			Resources: []ListenerResource{{
+				Names: config.Resources,
+			}},
+		}}
+	}
+	return w
+}
+
+// GenerateWorkerYAML outputs a worker config file using the provided
+// WorkerConfig.
+func GenerateWorkerYAML(config *WorkerConfig) ([]byte, error) {
+	return yaml.Marshal(NewWorker(config))
+}